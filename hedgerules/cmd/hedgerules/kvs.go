@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mrled/hedgerules/hedgerules/internal/functions"
+	"github.com/mrled/hedgerules/hedgerules/internal/kvs"
+)
+
+// runKVS runs the kvs subcommands, which work on one KVS by name.
+func runKVS(args []string) {
+	if len(args) < 1 {
+		kvsUsage()
+		os.Exit(1)
+	}
+	switch args[0] {
+	case "export":
+		runExport(args[1:])
+	case "import":
+		runImport(args[1:])
+	default:
+		kvsUsage()
+		os.Exit(1)
+	}
+}
+
+func kvsUsage() {
+	fmt.Fprintf(os.Stderr, "Usage: hedgerules kvs <command> [flags]\n\nCommands:\n  export  Write the contents of a KVS as a JSON snapshot\n  import  Sync a KVS to a JSON snapshot\n\nRun 'hedgerules kvs <command> --help' for flags.\n")
+}
+
+// kvsFlags are the flags shared by the kvs subcommands.
+type kvsFlags struct {
+	configPath *string
+	name       *string
+	region     *string
+	maxRetries *int
+}
+
+func addKVSFlags(fs *flag.FlagSet) kvsFlags {
+	return kvsFlags{
+		configPath: fs.String("config", "hedgerules.toml", "path to config file"),
+		name:       fs.String("name", "", "CloudFront KVS name"),
+		region:     fs.String("region", "", "AWS region override"),
+		maxRetries: fs.Int("max-retries", -1, fmt.Sprintf("max AWS throttle retries (default %d, 0 disables retries)", defaultMaxRetries)),
+	}
+}
+
+// config loads the config file, for settings like region and state-dir, and
+// applies the flags over it.
+func (f kvsFlags) config() config {
+	name, err := resolveAtFile(*f.name)
+	if err != nil {
+		fatal("--name: %v", err)
+	}
+	*f.name = name
+	region, err := resolveAtFile(*f.region)
+	if err != nil {
+		fatal("--region: %v", err)
+	}
+
+	cfg := loadConfig(*f.configPath)
+	if region != "" {
+		cfg.Region = region
+	}
+	if *f.maxRetries >= 0 {
+		cfg.MaxRetries = *f.maxRetries
+	} else if cfg.MaxRetries == 0 {
+		cfg.MaxRetries = defaultMaxRetries
+	}
+	if cfg.StateDir == "" {
+		cfg.StateDir = defaultStateDir
+	}
+	if cfg.KeepSnapshots == 0 {
+		cfg.KeepSnapshots = defaultKeepSnapshots
+	}
+	if cfg.Concurrency == 0 {
+		cfg.Concurrency = defaultConcurrency
+	}
+	return cfg
+}
+
+// runExport writes the contents of a KVS as a JSON snapshot, which
+// `hedgerules kvs import` can sync back.
+func runExport(args []string) {
+	fs := flag.NewFlagSet("kvs export", flag.ExitOnError)
+	flags := addKVSFlags(fs)
+	output := fs.String("output", "", "file to write the snapshot to (default standard output)")
+	fs.Parse(args)
+	cfg := flags.config()
+	if *flags.name == "" {
+		fatal("--name is required")
+	}
+
+	ctx := interruptContext()
+	cfClient, kvsClient, err := awsClients(ctx, cfg)
+	if err != nil {
+		fatal("%v", err)
+	}
+	arn, err := functions.ResolveKVSARN(ctx, cfClient, *flags.name, cfg.MaxRetries)
+	if err != nil {
+		fatal("resolving KVS: %v", err)
+	}
+	existing, etag, err := kvs.FetchExistingKeys(ctx, kvsClient, arn, cfg.MaxRetries)
+	if err != nil {
+		fatal("fetching %s: %v", *flags.name, err)
+	}
+
+	s := &kvs.Snapshot{KVSARN: arn, ETag: etag, Time: time.Now().UTC(), Entries: existing}
+	if *output == "" {
+		if err := s.Write(os.Stdout); err != nil {
+			fatal("%v", err)
+		}
+		return
+	}
+	var b bytes.Buffer
+	if err := s.Write(&b); err != nil {
+		fatal("%v", err)
+	}
+	if err := os.WriteFile(*output, b.Bytes(), 0o644); err != nil {
+		fatal("writing snapshot: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d keys from %s to %s\n", len(existing), *flags.name, *output)
+}
+
+// runImport syncs a KVS to a snapshot written by `hedgerules kvs export` or
+// saved by deploy, deleting keys the snapshot doesn't have. The KVS is the
+// snapshot's own unless --name names another.
+func runImport(args []string) {
+	fs := flag.NewFlagSet("kvs import", flag.ExitOnError)
+	flags := addKVSFlags(fs)
+	allowMassDelete := fs.Bool("allow-mass-delete", false, "sync even if the snapshot lacks more keys than max-delete-percent or max-delete-count allow")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: hedgerules kvs import [flags] SNAPSHOT\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	cfg := flags.config()
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fatal("%v", err)
+	}
+	s, err := kvs.ReadSnapshot(f)
+	f.Close()
+	if err != nil {
+		fatal("%s: %v", fs.Arg(0), err)
+	}
+	data := s.Data()
+	if errs := data.Validate(); len(errs) > 0 {
+		fmt.Fprintf(os.Stderr, "Validation errors:\n")
+		for _, e := range errs {
+			fmt.Fprintf(os.Stderr, "  %s: %s\n", e.Key, e.Message)
+		}
+		os.Exit(1)
+	}
+
+	ctx := interruptContext()
+	cfClient, kvsClient, err := awsClients(ctx, cfg)
+	if err != nil {
+		fatal("%v", err)
+	}
+	arn, label := s.KVSARN, functions.KVSIDFromARN(s.KVSARN)
+	if *flags.name != "" {
+		arn, err = functions.ResolveKVSARN(ctx, cfClient, *flags.name, cfg.MaxRetries)
+		if err != nil {
+			fatal("resolving KVS: %v", err)
+		}
+		label = *flags.name
+	}
+
+	// Restore the snapshot exactly, including keys hedgerules doesn't
+	// manage, and take no snapshot of its own: one of the state it replaces
+	// would become the newest, and the next rollback would restore that
+	cfg.TrackOwnership = false
+	cfg.BlueGreen = false
+	cfg.KeepSnapshots = -1
+	cfg.allowMassDelete = *allowMassDelete
+	if _, err := syncStore(ctx, kvsClient, cfg, label, arn, data); err != nil {
+		fatal("%v", err)
+	}
+	fmt.Fprintf(os.Stderr, "\nImported %d keys from %s.\n", len(data.Entries), fs.Arg(0))
+}
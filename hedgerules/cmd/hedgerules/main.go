@@ -2,16 +2,23 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/cloudfront"
 	"github.com/aws/aws-sdk-go-v2/service/cloudfrontkeyvaluestore"
 	"github.com/mrled/hedgerules/hedgerules/internal/functions"
+	"github.com/mrled/hedgerules/hedgerules/internal/headers"
 	"github.com/mrled/hedgerules/hedgerules/internal/hugo"
 	"github.com/mrled/hedgerules/hedgerules/internal/kvs"
 )
@@ -20,15 +27,56 @@ var version = "dev"
 
 const defaultMaxRetries = 10
 
+// defaultConcurrency is how many independent AWS operations, like syncing
+// the redirects and headers KVS, deploy runs at once.
+const defaultConcurrency = 2
+
+// defaultStateDir is where deploy keeps local state, like sync journals.
+const defaultStateDir = ".hedgerules"
+
+// defaultKeepSnapshots is how many snapshots of each KVS deploy keeps in the
+// state directory.
+const defaultKeepSnapshots = 5
+
+// maxSyncConflicts is how many times a sync re-plans after the KVS changes
+// underneath it before giving up.
+const maxSyncConflicts = 3
+
+// maxListedKeys is how many keys a report lists before summarizing the rest.
+const maxListedKeys = 10
+
 type config struct {
-	OutputDir          string `toml:"output-dir"`
-	Region             string `toml:"region"`
-	RedirectsKVSName   string `toml:"redirects-kvs-name"`
-	HeadersKVSName     string `toml:"headers-kvs-name"`
-	ViewerRequestName  string `toml:"viewer-request-name"`
-	ViewerResponseName string `toml:"viewer-response-name"`
-	DebugHeaders       bool   `toml:"debug-headers"`
-	MaxRetries         int    `toml:"max-retries"`
+	OutputDir          string  `toml:"output-dir"`
+	Region             string  `toml:"region"`
+	RedirectsKVSName   string  `toml:"redirects-kvs-name"`
+	HeadersKVSName     string  `toml:"headers-kvs-name"`
+	KVSName            string  `toml:"kvs-name"`
+	HashLongKeys       bool    `toml:"hash-long-keys"`
+	TrackOwnership     bool    `toml:"track-ownership"`
+	MaxDeletePercent   float64 `toml:"max-delete-percent"`
+	MaxDeleteCount     int     `toml:"max-delete-count"`
+	BlueGreen          bool    `toml:"blue-green"`
+	ViewerRequestName  string  `toml:"viewer-request-name"`
+	ViewerResponseName string  `toml:"viewer-response-name"`
+	DebugHeaders       bool    `toml:"debug-headers"`
+	CompileHeaders     bool    `toml:"compile-headers"`
+	ShareHeaders       bool    `toml:"share-headers"`
+	MaxRetries         int     `toml:"max-retries"`
+	Concurrency        int     `toml:"concurrency"`
+	StateDir           string  `toml:"state-dir"`
+	KeepSnapshots      int     `toml:"keep-snapshots"`
+	Security           string  `toml:"security"`
+	CSPHashes          bool    `toml:"csp-hashes"`
+	Noindex            bool    `toml:"noindex"`
+	Production         bool    `toml:"production"`
+
+	QueryString functions.QueryConfig `toml:"query-string"`
+	Cache       hugo.CacheConfig      `toml:"cache"`
+	Preload     hugo.PreloadConfig    `toml:"preload"`
+
+	// allowMassDelete is only set by --allow-mass-delete, never from the
+	// config file
+	allowMassDelete bool
 }
 
 func main() {
@@ -40,6 +88,10 @@ func main() {
 	switch os.Args[1] {
 	case "deploy":
 		runDeploy(os.Args[2:])
+	case "rollback":
+		runDeploy(append([]string{"--rollback"}, os.Args[2:]...))
+	case "kvs":
+		runKVS(os.Args[2:])
 	case "version":
 		fmt.Println(version)
 	default:
@@ -49,7 +101,7 @@ func main() {
 }
 
 func usage() {
-	fmt.Fprintf(os.Stderr, "Usage: hedgerules <command> [flags]\n\nCommands:\n  deploy   Sync KVS data and deploy CloudFront Functions\n  version  Print version\n\nRun 'hedgerules deploy --help' for deploy flags.\n")
+	fmt.Fprintf(os.Stderr, "Usage: hedgerules <command> [flags]\n\nCommands:\n  deploy      Sync KVS data and deploy CloudFront Functions\n  rollback    Undo the last deploy, same as deploy --rollback\n  kvs export  Write the contents of a KVS as a JSON snapshot\n  kvs import  Sync a KVS to a JSON snapshot\n  version     Print version\n\nRun 'hedgerules deploy --help' for deploy and rollback flags.\n")
 }
 
 func runDeploy(args []string) {
@@ -58,11 +110,25 @@ func runDeploy(args []string) {
 	outputDir := fs.String("output-dir", "", "Hugo build output directory")
 	redirectsKVS := fs.String("redirects-kvs-name", "", "CloudFront KVS name for redirects")
 	headersKVS := fs.String("headers-kvs-name", "", "CloudFront KVS name for headers")
+	sharedKVS := fs.String("kvs-name", "", "CloudFront KVS name for both redirects and headers, instead of one KVS each")
 	requestFunc := fs.String("request-function-name", "", "CloudFront Function name for viewer-request")
 	responseFunc := fs.String("response-function-name", "", "CloudFront Function name for viewer-response")
 	dryRun := fs.Bool("dry-run", false, "parse and validate only, print plan")
+	previewKVS := fs.Bool("preview-kvs", false, "with --dry-run, read each KVS to show what deploy would change and whether the delete limits would stop it (needs AWS credentials)")
+	blueGreen := fs.Bool("blue-green", false, "fill the standby of each blue/green KVS pair, then switch the functions to it")
+	rollback := fs.Bool("rollback", false, "undo the last deploy: with blue-green, switch the functions back to the standby KVS, otherwise restore each KVS from its latest snapshot")
 	region := fs.String("region", "", "AWS region override")
-	debugHeaders := fs.Bool("debug-headers", false, "inject debug headers into viewer-response function")
+	concurrency := fs.Int("concurrency", 0, fmt.Sprintf("max AWS operations to run at once, like syncing both KVS (default %d, 1 runs them one at a time)", defaultConcurrency))
+	stateDir := fs.String("state-dir", "", fmt.Sprintf("directory for local state like sync journals and snapshots (default %q)", defaultStateDir))
+	keepSnapshots := fs.Int("keep-snapshots", 0, fmt.Sprintf("snapshots of each KVS to keep in the state directory (default %d, -1 turns snapshots off)", defaultKeepSnapshots))
+	debugHeaders := fs.Bool("debug-headers", false, "inject debug headers into viewer-request and viewer-response functions")
+	compileHeaders := fs.Bool("compile-headers", false, "resolve the header cascade at deploy time, so viewer-response needs at most two KVS lookups")
+	shareHeaders := fs.Bool("share-headers", false, "store header sets used by several paths once, referenced from each path")
+	hashLongKeys := fs.Bool("hash-long-keys", false, fmt.Sprintf("store entries whose keys are longer than %d bytes under a hash of the key", kvs.MaxKeyBytes))
+	trackOwnership := fs.Bool("track-ownership", false, "record the keys deploy writes in each KVS, and delete only those, leaving keys added by hand alone")
+	maxDeletePercent := fs.Float64("max-delete-percent", 0, fmt.Sprintf("refuse to sync a plan deleting more than this percentage of a KVS's keys (default %d, 100 turns it off)", kvs.DefaultMaxDeletePercent))
+	maxDeleteCount := fs.Int("max-delete-count", 0, "refuse to sync a plan deleting more than this many of a KVS's keys (default no limit)")
+	allowMassDelete := fs.Bool("allow-mass-delete", false, "sync even if a plan deletes more keys than max-delete-percent or max-delete-count allow")
 	maxRetries := fs.Int("max-retries", -1, fmt.Sprintf("max AWS throttle retries (default %d, 0 disables retries)", defaultMaxRetries))
 	fs.Parse(args)
 
@@ -77,9 +143,11 @@ func runDeploy(args []string) {
 	*outputDir = mustResolve(*outputDir, "output-dir")
 	*redirectsKVS = mustResolve(*redirectsKVS, "redirects-kvs-name")
 	*headersKVS = mustResolve(*headersKVS, "headers-kvs-name")
+	*sharedKVS = mustResolve(*sharedKVS, "kvs-name")
 	*requestFunc = mustResolve(*requestFunc, "request-function-name")
 	*responseFunc = mustResolve(*responseFunc, "response-function-name")
 	*region = mustResolve(*region, "region")
+	*stateDir = mustResolve(*stateDir, "state-dir")
 
 	// Load config file
 	cfg := loadConfig(*configPath)
@@ -94,6 +162,9 @@ func runDeploy(args []string) {
 	if *headersKVS != "" {
 		cfg.HeadersKVSName = *headersKVS
 	}
+	if *sharedKVS != "" {
+		cfg.KVSName = *sharedKVS
+	}
 	if *requestFunc != "" {
 		cfg.ViewerRequestName = *requestFunc
 	}
@@ -103,9 +174,46 @@ func runDeploy(args []string) {
 	if *region != "" {
 		cfg.Region = *region
 	}
+	if *concurrency > 0 {
+		cfg.Concurrency = *concurrency
+	} else if cfg.Concurrency == 0 {
+		cfg.Concurrency = defaultConcurrency
+	}
+	if *stateDir != "" {
+		cfg.StateDir = *stateDir
+	} else if cfg.StateDir == "" {
+		cfg.StateDir = defaultStateDir
+	}
+	if *keepSnapshots != 0 {
+		cfg.KeepSnapshots = *keepSnapshots
+	} else if cfg.KeepSnapshots == 0 {
+		cfg.KeepSnapshots = defaultKeepSnapshots
+	}
 	if *debugHeaders {
 		cfg.DebugHeaders = true
 	}
+	if *compileHeaders {
+		cfg.CompileHeaders = true
+	}
+	if *shareHeaders {
+		cfg.ShareHeaders = true
+	}
+	if *hashLongKeys {
+		cfg.HashLongKeys = true
+	}
+	if *blueGreen {
+		cfg.BlueGreen = true
+	}
+	if *trackOwnership {
+		cfg.TrackOwnership = true
+	}
+	if *maxDeletePercent > 0 {
+		cfg.MaxDeletePercent = *maxDeletePercent
+	}
+	if *maxDeleteCount > 0 {
+		cfg.MaxDeleteCount = *maxDeleteCount
+	}
+	cfg.allowMassDelete = *allowMassDelete
 	if *maxRetries >= 0 {
 		cfg.MaxRetries = *maxRetries
 	} else if cfg.MaxRetries == 0 {
@@ -114,15 +222,31 @@ func runDeploy(args []string) {
 	}
 
 	// Validate required config
-	if cfg.OutputDir == "" {
+	if *rollback && *dryRun {
+		fatal("--rollback cannot be combined with --dry-run")
+	}
+	if *previewKVS && !*dryRun {
+		fatal("--preview-kvs only applies with --dry-run")
+	}
+	if cfg.OutputDir == "" && !*rollback {
 		fatal("output-dir is required (set in config file or via --output-dir)")
 	}
+	sharedStore := cfg.KVSName != ""
+	if sharedStore && (cfg.RedirectsKVSName != "" || cfg.HeadersKVSName != "") {
+		fatal("kvs-name cannot be combined with redirects-kvs-name or headers-kvs-name")
+	}
+	if cfg.MaxDeletePercent < 0 || cfg.MaxDeleteCount < 0 {
+		fatal("max-delete-percent and max-delete-count cannot be negative")
+	}
+	if *previewKVS && !sharedStore && (cfg.RedirectsKVSName == "" || cfg.HeadersKVSName == "") {
+		fatal("--preview-kvs needs kvs-name, or redirects-kvs-name and headers-kvs-name")
+	}
 	if !*dryRun {
-		if cfg.RedirectsKVSName == "" {
-			fatal("redirects-kvs-name is required (set in config file or via --redirects-kvs-name)")
+		if !sharedStore && cfg.RedirectsKVSName == "" {
+			fatal("redirects-kvs-name is required (set in config file or via --redirects-kvs-name), unless kvs-name is set")
 		}
-		if cfg.HeadersKVSName == "" {
-			fatal("headers-kvs-name is required (set in config file or via --headers-kvs-name)")
+		if !sharedStore && cfg.HeadersKVSName == "" {
+			fatal("headers-kvs-name is required (set in config file or via --headers-kvs-name), unless kvs-name is set")
 		}
 		if cfg.ViewerRequestName == "" {
 			fatal("request-function-name is required (set in config file or via --request-function-name)")
@@ -131,6 +255,18 @@ func runDeploy(args []string) {
 			fatal("response-function-name is required (set in config file or via --response-function-name)")
 		}
 	}
+	if cfg.Noindex && cfg.Production {
+		fatal("noindex is set, but this config is marked production = true")
+	}
+	if err := cfg.QueryString.Validate(); err != nil {
+		fatal("%v", err)
+	}
+	queryPolicies := cfg.QueryString.Policies()
+
+	if *rollback {
+		runRollback(cfg, queryPolicies)
+		return
+	}
 
 	// Step 1: Parse Hugo output
 	fmt.Fprintf(os.Stderr, "Scanning directories in %s...\n", cfg.OutputDir)
@@ -150,20 +286,133 @@ func runDeploy(args []string) {
 	redirectEntries := hugo.MergeRedirects(dirEntries, fileEntries)
 	fmt.Fprintf(os.Stderr, "Total redirects after merge: %d\n", len(redirectEntries))
 
+	siteFiles, err := hugo.ScanFiles(cfg.OutputDir)
+	if err != nil {
+		fatal("scanning files: %v", err)
+	}
+
+	// Generated rules go beneath the ones in _hedge_headers.json (see
+	// hugo.ParseHeaders)
+	baseHeaders := cfg.Cache.Rules(siteFiles)
+	if cfg.Security != "" {
+		preset, err := headers.Preset(cfg.Security)
+		if err != nil {
+			fatal("security: %v", err)
+		}
+		baseHeaders["/"] = headers.Merge(baseHeaders["/"], preset)
+	}
+
 	fmt.Fprintf(os.Stderr, "Parsing _hedge_headers.json...\n")
-	headerEntries, err := hugo.ParseHeaders(cfg.OutputDir)
+	headerEntries, headerErrors, err := hugo.ParseHeaders(cfg.OutputDir, baseHeaders)
 	if err != nil {
 		fatal("parsing _hedge_headers.json: %v", err)
 	}
 	fmt.Fprintf(os.Stderr, "Found %d header entries\n", len(headerEntries))
 
+	var cspWarnings, preloadWarnings []kvs.ValidationError
+	if cfg.CSPHashes {
+		fmt.Fprintf(os.Stderr, "Hashing inline scripts and styles...\n")
+		hashes, err := hugo.ScanInlineHashes(cfg.OutputDir)
+		if err != nil {
+			fatal("%v", err)
+		}
+		fmt.Fprintf(os.Stderr, "Found inline scripts or styles in %d pages\n", len(hashes))
+		var cspErrors []kvs.ValidationError
+		headerEntries, cspErrors, cspWarnings = hugo.AddCSPHashes(headerEntries, hashes)
+		headerErrors = append(headerErrors, cspErrors...)
+	}
+	if cfg.Preload.Enabled {
+		fmt.Fprintf(os.Stderr, "Finding stylesheets and fonts to preload...\n")
+		preloads, err := cfg.Preload.ScanPreloads(cfg.OutputDir)
+		if err != nil {
+			fatal("%v", err)
+		}
+		fmt.Fprintf(os.Stderr, "Found preloads for %d pages\n", len(preloads))
+		var preloadErrors []kvs.ValidationError
+		headerEntries, preloadErrors, preloadWarnings = cfg.Preload.AddPreloadLinks(headerEntries, preloads)
+		headerErrors = append(headerErrors, preloadErrors...)
+	}
+	if cfg.Noindex {
+		fmt.Fprintf(os.Stderr, "Setting X-Robots-Tag: %s on every response\n", hugo.NoindexValue)
+		headerEntries, err = hugo.ApplyNoindex(headerEntries)
+		if err != nil {
+			fatal("applying noindex: %v", err)
+		}
+	}
+
+	// The cascade is checked as written, before compiling or sharing it
+	validationErrors := headerErrors
+	headerUsage, budgetErrors, budgetWarnings := hugo.CheckHeaderBudget(siteFiles, headerEntries)
+	budgetWarnings = append(preloadWarnings, budgetWarnings...)
+	validationErrors = append(validationErrors, budgetErrors...)
+
+	policyWarnings := append(cspWarnings, hugo.PolicyWarnings(headerEntries)...)
+	var lookupWarnings []kvs.ValidationError
+	cascadeStats := (&kvs.Data{Entries: headerEntries}).Stats()
+	if cfg.CompileHeaders {
+		headerEntries, err = hugo.CompileHeaders(siteFiles, headerEntries)
+		if err != nil {
+			fatal("%v", err)
+		}
+		fmt.Fprintf(os.Stderr, "Compiled %d header entries\n", len(headerEntries))
+	} else {
+		if cfg.ShareHeaders {
+			headerEntries = hugo.ShareHeaders(headerEntries)
+		}
+		lookupWarnings = hugo.CheckLookups(siteFiles, headerEntries)
+	}
+	scopedGlobs := !cfg.CompileHeaders && hugo.HasScopedGlobs(headerEntries)
+
 	// Step 2: Validate
 	redirectData := &kvs.Data{Entries: redirectEntries}
-	headerData := &kvs.Data{Entries: headerEntries}
+	headerData := &kvs.Data{Entries: headerEntries, CheckValue: headers.CheckValue}
+
+	// validateStore validates the data sets that go in one KVS, after
+	// hashing their long keys if enabled, and returns them as stored. The
+	// ownership manifest, if tracked, counts towards the KVS size.
+	validateStore := func(sets ...*kvs.Data) []*kvs.Data {
+		if cfg.HashLongKeys {
+			var hashErrors []kvs.ValidationError
+			sets, hashErrors = kvs.HashLongKeys(sets...)
+			validationErrors = append(validationErrors, hashErrors...)
+		}
+		checked := sets
+		if cfg.TrackOwnership {
+			checked = append(checked[:len(checked):len(checked)], kvs.Manifest(sets...))
+		}
+		validationErrors = append(validationErrors, kvs.ValidateStore(checked...)...)
+		return sets
+	}
 
-	var validationErrors []kvs.ValidationError
-	validationErrors = append(validationErrors, redirectData.Validate()...)
-	validationErrors = append(validationErrors, headerData.Validate()...)
+	if sharedStore {
+		// One KVS holds both data sets, told apart by key prefix
+		stored := validateStore(redirectData.WithPrefix(kvs.RedirectsPrefix), headerData.WithPrefix(kvs.HeadersPrefix))
+		redirectData, headerData = stored[0], stored[1]
+	} else {
+		redirectData = validateStore(redirectData)[0]
+		headerData = validateStore(headerData)[0]
+	}
+
+	if len(policyWarnings) > 0 {
+		fmt.Fprintf(os.Stderr, "\nSecurity header warnings:\n")
+		for _, w := range policyWarnings {
+			fmt.Fprintf(os.Stderr, "  %s: %s\n", w.Key, w.Message)
+		}
+	}
+
+	if len(budgetWarnings) > 0 {
+		fmt.Fprintf(os.Stderr, "\nHeader budget warnings:\n")
+		for _, w := range budgetWarnings {
+			fmt.Fprintf(os.Stderr, "  %s: %s\n", w.Key, w.Message)
+		}
+	}
+
+	if len(lookupWarnings) > 0 {
+		fmt.Fprintf(os.Stderr, "\nHeader lookup warnings:\n")
+		for _, w := range lookupWarnings {
+			fmt.Fprintf(os.Stderr, "  %s: %s\n", w.Key, w.Message)
+		}
+	}
 
 	if len(validationErrors) > 0 {
 		fmt.Fprintf(os.Stderr, "\nValidation errors:\n")
@@ -184,92 +433,708 @@ func runDeploy(args []string) {
 	fmt.Fprintf(os.Stderr, "  Headers:   %d keys, %d / %d bytes (%.1f%%)\n",
 		headerStats.NumKeys, headerStats.TotalBytes, kvs.MaxTotalBytes,
 		float64(headerStats.TotalBytes)/float64(kvs.MaxTotalBytes)*100)
+	if sharedStore {
+		fmt.Fprintf(os.Stderr, "  Combined:  %d keys, %d / %d bytes (%.1f%%)\n",
+			redirectStats.NumKeys+headerStats.NumKeys, redirectStats.TotalBytes+headerStats.TotalBytes, kvs.MaxTotalBytes,
+			float64(redirectStats.TotalBytes+headerStats.TotalBytes)/float64(kvs.MaxTotalBytes)*100)
+	}
+	if cfg.CompileHeaders {
+		fmt.Fprintf(os.Stderr, "  Compiled:  %+d bytes over the %d-byte cascade (%d keys), for at most 2 lookups per response\n",
+			headerStats.TotalBytes-cascadeStats.TotalBytes, cascadeStats.TotalBytes, cascadeStats.NumKeys)
+	} else if cfg.ShareHeaders {
+		fmt.Fprintf(os.Stderr, "  Shared:    %d bytes saved over the %d-byte cascade\n",
+			cascadeStats.TotalBytes-headerStats.TotalBytes, cascadeStats.TotalBytes)
+	}
+	if headerUsage.Path != "" {
+		fmt.Fprintf(os.Stderr, "  Headers per response: %d / %d bytes worst case (%s)\n",
+			headerUsage.Size, headers.Budget, headerUsage.Path)
+	}
+
+	// The data each KVS holds: the redirects KVS, then the headers KVS
+	stores := []kvsStore{{"Redirects", redirectData}, {"Headers", headerData}}
+	if sharedStore {
+		stores = []kvsStore{{"Redirects and headers", kvs.Combine(redirectData, headerData)}}
+	}
 
 	// Step 3: Dry run - print plan and exit
 	if *dryRun {
 		fmt.Println("\n=== Redirects ===")
-		for _, e := range redirectEntries {
+		for _, e := range redirectData.Entries {
 			fmt.Printf("%s -> %s\n", e.Key, e.Value)
 		}
 		fmt.Println("\n=== Headers ===")
-		for _, e := range headerEntries {
+		for _, e := range headerData.Entries {
 			fmt.Printf("%s:\n%s\n---\n", e.Key, e.Value)
 		}
+		fmt.Println("\n=== Query strings ===")
+		for _, p := range queryPolicies {
+			if p.Prefix != "" {
+				fmt.Printf("%s: %s\n", p.Prefix, p)
+			}
+		}
+		fmt.Printf("(default): %s\n", cfg.QueryString.QueryPolicy)
+
+		// With --preview-kvs, read the stores to show what deploy would
+		// change, whether the delete limits would stop it, and which keys it
+		// would leave alone. Otherwise the dry run stays offline.
+		if *previewKVS {
+			if err := previewStores(cfg, stores); err != nil {
+				fatal("previewing KVS changes: %v", err)
+			}
+		}
 		fmt.Fprintf(os.Stderr, "\nDry run complete. No changes made.\n")
 		return
 	}
 
 	// Step 4: Set up AWS clients
-	ctx := context.Background()
+	ctx := interruptContext()
+	cfClient, kvsClient, err := awsClients(ctx, cfg)
+	if err != nil {
+		fatal("%v", err)
+	}
+
+	// Step 5: Resolve KVS ARNs
+	redirectsARN, headersARN, err := resolveStores(ctx, cfClient, cfg)
+	if err != nil {
+		fatal("%v", err)
+	}
+	arns := []string{redirectsARN, headersARN}
+
+	// Step 6: Sync KVS data, the stores in parallel once all are planned
+	fmt.Fprintf(os.Stderr, "Syncing KVS...\n")
+	calls := syncStores(ctx, kvsClient, cfg, stores, arns)
+
+	// Step 7: Deploy CloudFront Functions, switching them to the standby
+	// stores in blue/green mode
+	deployFunctions(ctx, cfClient, cfg, queryPolicies, scopedGlobs, redirectsARN, headersARN)
+
+	fmt.Fprintf(os.Stderr, "\nKVS API calls:\n")
+	for i, s := range stores {
+		fmt.Fprintf(os.Stderr, "  %s KVS: %d\n", s.label, calls[i])
+	}
+	fmt.Fprintf(os.Stderr, "\nDeploy complete.\n")
+}
+
+// runRollback undoes the last deploy. In blue/green mode it switches the
+// functions back to the standby stores of each pair, which hold what the
+// previous deploy synced, publishing the code it saved with them. Otherwise
+// it syncs each KVS back to its latest snapshot, which the last deploy took
+// before changing it, and leaves the functions as they are. A deploy that
+// changed how the functions read the KVS, like turning compile-headers or
+// share-headers on or off, isn't undone that way.
+func runRollback(cfg config, queryPolicies []functions.QueryPolicy) {
+	ctx := interruptContext()
+	cfClient, kvsClient, err := awsClients(ctx, cfg)
+	if err != nil {
+		fatal("%v", err)
+	}
+	redirectsARN, headersARN, err := resolveStores(ctx, cfClient, cfg)
+	if err != nil {
+		fatal("%v", err)
+	}
+	if !cfg.BlueGreen {
+		restoreSnapshots(ctx, kvsClient, cfg, redirectsARN, headersARN)
+		return
+	}
+	for _, arn := range []string{redirectsARN, headersARN} {
+		n, err := kvs.CountKeys(ctx, kvsClient, arn, cfg.MaxRetries)
+		if err != nil {
+			fatal("checking standby KVS: %v", err)
+		}
+		if n == 0 {
+			fatal("standby KVS %s is empty, so there is nothing to roll back to", arn)
+		}
+	}
+	// Publish the code each function had when it last used its standby
+	// store. Without it, rebuild the functions from the current config, and
+	// check the standby header store for scoped glob keys as deploy checks
+	// the entries it syncs.
+	deployments := buildFunctions(cfg, queryPolicies, false, redirectsARN, headersARN)
+	saved := make([][]byte, len(deployments))
+	rebuild := false
+	for i, d := range deployments {
+		code, err := os.ReadFile(functionCodePath(cfg, d))
+		switch {
+		case err == nil:
+			saved[i] = code
+		case errors.Is(err, os.ErrNotExist):
+			fmt.Fprintf(os.Stderr, "%s: no saved code for %s, rebuilding it from the current config\n", d.Name, d.KVSARN)
+			rebuild = true
+		default:
+			fatal("reading saved function code: %v", err)
+		}
+	}
+	if rebuild && !cfg.CompileHeaders {
+		scopedGlobs, err := storeHasScopedGlobs(ctx, kvsClient, cfg, headersARN)
+		if err != nil {
+			fatal("checking standby header KVS: %v", err)
+		}
+		deployments = buildFunctions(cfg, queryPolicies, scopedGlobs, redirectsARN, headersARN)
+	}
+	for i, code := range saved {
+		if code != nil {
+			deployments[i].Code = code
+		}
+	}
+	publishFunctions(ctx, cfClient, cfg, deployments)
+	fmt.Fprintf(os.Stderr, "\nRollback complete.\n")
+}
+
+// storeHasScopedGlobs reports whether the header KVS at arn has
+// directory-scoped extension keys (see hugo.HasScopedGlobs).
+func storeHasScopedGlobs(ctx context.Context, kvsClient kvs.KVSClient, cfg config, arn string) (bool, error) {
+	existing, _, err := kvs.FetchExistingKeys(ctx, kvsClient, arn, cfg.MaxRetries)
+	if err != nil {
+		return false, err
+	}
+	store := existing
+	if cfg.KVSName != "" {
+		store = make(map[string]string)
+		for key, value := range existing {
+			if strings.HasPrefix(key, kvs.HeadersPrefix) {
+				store[strings.TrimPrefix(key, kvs.HeadersPrefix)] = value
+			}
+		}
+	}
+	return headers.HasScopedGlobs(store), nil
+}
+
+func awsClients(ctx context.Context, cfg config) (*cloudfront.Client, *cloudfrontkeyvaluestore.Client, error) {
 	var awsOpts []func(*awsconfig.LoadOptions) error
 	if cfg.Region != "" {
 		awsOpts = append(awsOpts, awsconfig.WithRegion(cfg.Region))
 	}
 	awsCfg, err := awsconfig.LoadDefaultConfig(ctx, awsOpts...)
 	if err != nil {
-		fatal("loading AWS config: %v", err)
+		return nil, nil, fmt.Errorf("loading AWS config: %w", err)
 	}
+	return cloudfront.NewFromConfig(awsCfg), cloudfrontkeyvaluestore.NewFromConfig(awsCfg), nil
+}
 
-	cfClient := cloudfront.NewFromConfig(awsCfg)
-	kvsClient := cloudfrontkeyvaluestore.NewFromConfig(awsCfg)
-
-	// Step 5: Resolve KVS ARNs
+// resolveStores returns the ARNs of the KVS for the viewer-request and
+// viewer-response functions, which are the same when kvs-name is set. In
+// blue/green mode these are the standby stores of each pair.
+func resolveStores(ctx context.Context, cfClient *cloudfront.Client, cfg config) (redirectsARN, headersARN string, err error) {
 	fmt.Fprintf(os.Stderr, "Resolving KVS ARNs...\n")
-	redirectsARN, err := functions.ResolveKVSARN(ctx, cfClient, cfg.RedirectsKVSName, cfg.MaxRetries)
+	type store struct {
+		label, name, function string
+	}
+	stores := []store{
+		{"Redirects KVS", cfg.RedirectsKVSName, cfg.ViewerRequestName},
+		{"Headers KVS", cfg.HeadersKVSName, cfg.ViewerResponseName},
+	}
+	if cfg.KVSName != "" {
+		stores = []store{{"KVS", cfg.KVSName, cfg.ViewerRequestName}}
+	}
+	var names []string
+	for _, st := range stores {
+		if cfg.BlueGreen {
+			blue, green := functions.BlueGreenNames(st.name)
+			names = append(names, blue, green)
+		} else {
+			names = append(names, st.name)
+		}
+	}
+
+	// One listing resolves every name, alongside looking up which stores
+	// the functions use in blue/green mode
+	var arns map[string]string
+	live := make([]string, len(stores))
+	tasks := []func() error{func() error {
+		var err error
+		arns, err = functions.ResolveKVSARNs(ctx, cfClient, names, cfg.MaxRetries)
+		return err
+	}}
+	if cfg.BlueGreen {
+		for i, st := range stores {
+			i, st := i, st
+			tasks = append(tasks, func() error {
+				arn, err := functions.LiveKVSARN(ctx, cfClient, st.function, cfg.MaxRetries)
+				if err != nil {
+					return fmt.Errorf("finding the live %s: %w", strings.ToLower(st.label), err)
+				}
+				live[i] = arn
+				return nil
+			})
+		}
+	}
+	if err := parallel(cfg.Concurrency, tasks...); err != nil {
+		return "", "", fmt.Errorf("resolving KVS: %w", err)
+	}
+
+	resolved := make([]string, len(stores))
+	for i, st := range stores {
+		if !cfg.BlueGreen {
+			resolved[i] = arns[st.name]
+			fmt.Fprintf(os.Stderr, "%s: %s\n", st.label, resolved[i])
+			continue
+		}
+		blue, green := functions.BlueGreenNames(st.name)
+		resolved[i] = functions.Standby(live[i], arns[blue], arns[green])
+		if live[i] == "" {
+			live[i] = "none"
+		}
+		fmt.Fprintf(os.Stderr, "%s: %s (live: %s)\n", st.label, resolved[i], live[i])
+	}
+	if len(resolved) == 1 {
+		return resolved[0], resolved[0], nil
+	}
+	return resolved[0], resolved[1], nil
+}
+
+// parallel runs tasks, at most limit at a time, and returns all of their
+// errors joined, so one failure doesn't hide another.
+func parallel(limit int, tasks ...func() error) error {
+	sem := make(chan struct{}, max(limit, 1))
+	errs := make([]error, len(tasks))
+	var wg sync.WaitGroup
+	for i, task := range tasks {
+		wg.Add(1)
+		go func(i int, task func() error) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			errs[i] = task()
+		}(i, task)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// deployFunctions builds both CloudFront Functions for the given stores and
+// publishes them. scopedGlobs is whether the header KVS has directory-scoped
+// extension keys.
+func deployFunctions(ctx context.Context, cfClient *cloudfront.Client, cfg config, queryPolicies []functions.QueryPolicy, scopedGlobs bool, redirectsARN, headersARN string) {
+	publishFunctions(ctx, cfClient, cfg, buildFunctions(cfg, queryPolicies, scopedGlobs, redirectsARN, headersARN))
+}
+
+// buildFunctions returns the viewer-request and viewer-response functions
+// for the given stores.
+func buildFunctions(cfg config, queryPolicies []functions.QueryPolicy, scopedGlobs bool, redirectsARN, headersARN string) []functions.Deployment {
+	var redirectsPrefix, headersPrefix string
+	if cfg.KVSName != "" {
+		redirectsPrefix, headersPrefix = kvs.RedirectsPrefix, kvs.HeadersPrefix
+	}
+	requestCode := functions.BuildFunctionCode(functions.ViewerRequestJS, functions.Vars{
+		KVSID:         functions.KVSIDFromARN(redirectsARN),
+		DebugHeaders:  cfg.DebugHeaders,
+		KeyPrefix:     redirectsPrefix,
+		QueryPolicies: queryPolicies,
+	})
+	responseCode := functions.BuildFunctionCode(functions.ViewerResponseJS, functions.Vars{
+		KVSID:           functions.KVSIDFromARN(headersARN),
+		DebugHeaders:    cfg.DebugHeaders,
+		KeyPrefix:       headersPrefix,
+		CompiledHeaders: cfg.CompileHeaders,
+		ScopedGlobs:     scopedGlobs,
+	})
+	return []functions.Deployment{
+		{Name: cfg.ViewerRequestName, Code: requestCode, KVSARN: redirectsARN},
+		{Name: cfg.ViewerResponseName, Code: responseCode, KVSARN: headersARN},
+	}
+}
+
+// publishFunctions deploys the functions together (see
+// functions.DeployFunctions). In blue/green mode, it then saves the code of
+// each function with the store it uses, so rollback can publish it again.
+func publishFunctions(ctx context.Context, cfClient *cloudfront.Client, cfg config, deployments []functions.Deployment) {
+	fmt.Fprintf(os.Stderr, "Deploying viewer-request and viewer-response functions...\n")
+	if err := functions.DeployFunctions(ctx, cfClient, deployments, cfg.MaxRetries); err != nil {
+		fatal("deploying functions: %v", err)
+	}
+	if !cfg.BlueGreen {
+		return
+	}
+	for _, d := range deployments {
+		path := functionCodePath(cfg, d)
+		err := os.MkdirAll(filepath.Dir(path), 0o755)
+		if err == nil {
+			err = os.WriteFile(path, d.Code, 0o644)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: saving function code for rollback: %v\n", d.Name, err)
+		}
+	}
+}
+
+// functionCodePath returns where blue/green deploys save the code of a
+// function published with the KVS it uses.
+func functionCodePath(cfg config, d functions.Deployment) string {
+	return filepath.Join(cfg.StateDir, "functions", functions.KVSIDFromARN(d.KVSARN), d.Name+".js")
+}
+
+// kvsStore is the data deploy syncs to one KVS.
+type kvsStore struct {
+	label string
+	data  *kvs.Data
+}
+
+// planSync plans bringing a KVS holding existing in line with data. With
+// track-ownership, the plan leaves keys hedgerules doesn't manage alone, and
+// writes the ownership manifest in stages around its deletes.
+func planSync(cfg config, data *kvs.Data, existing map[string]string) (*kvs.SyncPlan, error) {
+	plan := kvs.ComputeSyncPlan(data, existing)
+	if cfg.TrackOwnership {
+		plan.KeepUnmanaged(existing)
+		if err := plan.StageManifest(data, existing); err != nil {
+			return nil, err
+		}
+	}
+	return plan, nil
+}
+
+// ops returns the number of operations in plan.
+func ops(plan *kvs.SyncPlan) int {
+	puts, deletes := plan.Size()
+	return puts + deletes
+}
+
+// storedData returns data as deploy stores it, which with track-ownership
+// includes the ownership manifest.
+func storedData(cfg config, data *kvs.Data) *kvs.Data {
+	if !cfg.TrackOwnership {
+		return data
+	}
+	return kvs.Combine(data, kvs.Manifest(data))
+}
+
+// previewStores prints what deploy would change in each store, without
+// changing anything.
+func previewStores(cfg config, stores []kvsStore) error {
+	ctx := interruptContext()
+	cfClient, kvsClient, err := awsClients(ctx, cfg)
 	if err != nil {
-		fatal("resolving redirects KVS: %v", err)
+		return err
 	}
-	fmt.Fprintf(os.Stderr, "Redirects KVS: %s\n", redirectsARN)
+	redirectsARN, headersARN, err := resolveStores(ctx, cfClient, cfg)
+	if err != nil {
+		return err
+	}
+	arns := []string{redirectsARN, headersARN}
+	fmt.Fprintf(os.Stderr, "\nKVS changes:\n")
+	for i, s := range stores {
+		if err := previewStore(ctx, kvsClient, cfg, s.label, arns[i], s.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	headersARN, err := functions.ResolveKVSARN(ctx, cfClient, cfg.HeadersKVSName, cfg.MaxRetries)
+// previewStore prints what syncing data to the KVS at arn would change, and
+// the keys it would leave alone, without changing anything.
+func previewStore(ctx context.Context, client kvs.KVSClient, cfg config, label, arn string, data *kvs.Data) error {
+	existing, _, err := kvs.FetchExistingKeys(ctx, client, arn, cfg.MaxRetries)
+	if err != nil {
+		return fmt.Errorf("fetching existing %s: %w", strings.ToLower(label), err)
+	}
+	plan, err := planSync(cfg, storedData(cfg, data), existing)
 	if err != nil {
-		fatal("resolving headers KVS: %v", err)
+		fmt.Fprintf(os.Stderr, "%s: deploy would refuse this: %v\n", label, err)
+		return nil
 	}
-	fmt.Fprintf(os.Stderr, "Headers KVS: %s\n", headersARN)
+	puts, deletes := plan.Size()
+	fmt.Fprintf(os.Stderr, "  %s: %d puts, %d deletes\n", label, puts, deletes)
+	if err := checkDeletes(cfg, label, plan, len(existing)); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: deploy would refuse this: %v\n", label, err)
+	}
+	printUnmanaged(label, plan)
+	return nil
+}
 
-	// Step 6: Sync redirects KVS
-	fmt.Fprintf(os.Stderr, "Syncing redirects KVS...\n")
-	redirectsCounter := &kvs.CountingKVSClient{Client: kvsClient}
-	existingRedirects, redirectEtag, err := kvs.FetchExistingKeys(ctx, redirectsCounter, redirectsARN, cfg.MaxRetries)
+// checkDeletes returns an error if plan deletes more of the existing keys
+// in a KVS than the configured limit allows, unless --allow-mass-delete is
+// set, and prints the first keys it deletes so the operator can see why.
+func checkDeletes(cfg config, label string, plan *kvs.SyncPlan, existing int) error {
+	limit := kvs.DeleteLimit{Percent: cfg.MaxDeletePercent, Count: cfg.MaxDeleteCount}
+	err := limit.Check(plan, existing)
+	if err == nil {
+		return nil
+	}
+	deletes := append([]string(nil), plan.Deletes...)
+	sort.Strings(deletes)
+	if cfg.allowMassDelete {
+		fmt.Fprintf(os.Stderr, "%s: %v; deleting anyway (--allow-mass-delete):\n", label, err)
+		printKeys(deletes)
+		return nil
+	}
+	fmt.Fprintf(os.Stderr, "%s: deleting %d keys, including:\n", label, len(deletes))
+	printKeys(deletes)
+	return err
+}
+
+// printUnmanaged lists the keys a plan leaves alone because hedgerules
+// doesn't manage them.
+func printUnmanaged(label string, plan *kvs.SyncPlan) {
+	if len(plan.Unmanaged) == 0 {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%s: leaving %d unmanaged keys alone:\n", label, len(plan.Unmanaged))
+	printKeys(plan.Unmanaged)
+}
+
+// restoreSnapshots syncs each KVS back to its latest snapshot. It saves no
+// snapshot of its own, so the latest stays the one the last deploy took, and
+// running it again restores the same data rather than what it replaced.
+func restoreSnapshots(ctx context.Context, client kvs.KVSClient, cfg config, redirectsARN, headersARN string) {
+	labels, arns := []string{"Redirects", "Headers"}, []string{redirectsARN, headersARN}
+	if redirectsARN == headersARN {
+		labels, arns = []string{"Redirects and headers"}, arns[:1]
+	}
+	snapshots := make([]*kvs.Snapshot, len(arns))
+	for i, arn := range arns {
+		s, path, err := kvs.LatestSnapshot(snapshotDir(cfg, arn))
+		if err != nil {
+			fatal("%v", err)
+		}
+		if s == nil {
+			fatal("no snapshot of %s in %s, so there is nothing to roll back to", arn, snapshotDir(cfg, arn))
+		}
+		fmt.Fprintf(os.Stderr, "%s: restoring %d keys from %s (taken %s)\n", labels[i], len(s.Entries), path, s.Time.Local().Format(time.RFC1123))
+		snapshots[i] = s
+	}
+
+	// Restore each KVS exactly, including keys hedgerules doesn't manage
+	cfg.TrackOwnership = false
+	cfg.KeepSnapshots = -1
+	stores := make([]kvsStore, len(arns))
+	for i := range arns {
+		stores[i] = kvsStore{labels[i], snapshots[i].Data()}
+	}
+	syncStores(ctx, client, cfg, stores, arns)
+	fmt.Fprintf(os.Stderr, "\nRollback complete.\n")
+}
+
+// snapshotDir returns the directory of the snapshots of the KVS at arn.
+func snapshotDir(cfg config, arn string) string {
+	return filepath.Join(cfg.StateDir, "snapshots", functions.KVSIDFromARN(arn))
+}
+
+// saveSnapshot saves the contents of the KVS at arn before a sync changes
+// them, unless snapshots are off. Blue/green deploys don't need them, since
+// they leave the live store alone.
+func saveSnapshot(cfg config, label, arn, etag string, existing map[string]string) error {
+	if cfg.KeepSnapshots <= 0 || cfg.BlueGreen {
+		return nil
+	}
+	s := &kvs.Snapshot{KVSARN: arn, ETag: etag, Time: time.Now().UTC(), Entries: existing}
+	path, err := kvs.SaveSnapshot(snapshotDir(cfg, arn), s, cfg.KeepSnapshots)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%s: saved a snapshot of %d keys to %s\n", label, len(existing), path)
+	return nil
+}
+
+// syncStores plans the sync of every store before starting any, so a plan
+// that fails a check, like the mass deletion limit, stops before anything
+// changes. It then syncs the stores in parallel, and returns the number of
+// KVS API calls each one took.
+func syncStores(ctx context.Context, client kvs.KVSClient, cfg config, stores []kvsStore, arns []string) []int {
+	syncs := make([]*storeSync, len(stores))
+	tasks := make([]func() error, len(stores))
+	for i, s := range stores {
+		i, s := i, s
+		tasks[i] = func() error {
+			var err error
+			syncs[i], err = planStore(ctx, client, cfg, s.label, arns[i], s.data)
+			return err
+		}
+	}
+	if err := parallel(cfg.Concurrency, tasks...); err != nil {
+		fatal("%v", err)
+	}
+
+	calls := make([]int, len(stores))
+	for i := range syncs {
+		i := i
+		tasks[i] = func() error {
+			var err error
+			calls[i], err = syncs[i].run(ctx, cfg)
+			return err
+		}
+	}
+	if err := parallel(cfg.Concurrency, tasks...); err != nil {
+		fatal("%v", err)
+	}
+	return calls
+}
+
+// syncStore plans and runs the sync of one KVS (see planStore and
+// storeSync.run), and returns the number of KVS API calls it took.
+func syncStore(ctx context.Context, client kvs.KVSClient, cfg config, label, arn string, data *kvs.Data) (int, error) {
+	s, err := planStore(ctx, client, cfg, label, arn, data)
+	if err != nil {
+		return 0, err
+	}
+	return s.run(ctx, cfg)
+}
+
+// storeSync is the planned sync of one KVS.
+type storeSync struct {
+	label, arn  string
+	data        *kvs.Data
+	counter     *kvs.CountingKVSClient
+	journalPath string
+	journal     *kvs.Journal // Set when resuming
+	existing    map[string]string
+	etag        string
+	plan        *kvs.SyncPlan
+}
+
+// planStore plans bringing the KVS at arn in line with data, printing the
+// plan under label later. Progress is journaled in the state directory. If
+// a previous sync of the same data to the same KVS stopped partway, and the
+// KVS hasn't changed since, the plan resumes it without listing the KVS
+// again. A fresh plan is checked against the configured delete limit.
+func planStore(ctx context.Context, client kvs.KVSClient, cfg config, label, arn string, data *kvs.Data) (*storeSync, error) {
+	s := &storeSync{
+		label:       label,
+		arn:         arn,
+		data:        storedData(cfg, data),
+		counter:     &kvs.CountingKVSClient{Client: client},
+		journalPath: filepath.Join(cfg.StateDir, "sync-"+functions.KVSIDFromARN(arn)+".json"),
+	}
+	journal, err := kvs.LoadJournal(s.journalPath)
 	if err != nil {
-		fatal("fetching existing redirects: %v", err)
+		return nil, err
 	}
-	redirectPlan := kvs.ComputeSyncPlan(redirectData, existingRedirects)
-	fmt.Fprintf(os.Stderr, "Redirects: %d puts, %d deletes\n", len(redirectPlan.Puts), len(redirectPlan.Deletes))
-	if err := kvs.Sync(ctx, redirectsCounter, redirectsARN, redirectEtag, redirectPlan, cfg.MaxRetries); err != nil {
-		fatal("syncing redirects: %v", err)
+	if journal != nil && journal.Matches(arn, s.data) {
+		etag, err := kvs.CurrentETag(ctx, s.counter, arn, cfg.MaxRetries)
+		if err != nil {
+			return nil, fmt.Errorf("checking %s KVS: %w", strings.ToLower(label), err)
+		}
+		if etag == journal.ETag {
+			s.journal, s.etag, s.plan = journal, etag, journal.Remaining()
+			fmt.Fprintf(os.Stderr, "%s: resuming a sync that stopped after %d of %d operations\n",
+				label, journal.Done, ops(&journal.Plan))
+			return s, nil
+		}
+		fmt.Fprintf(os.Stderr, "%s: KVS changed since a sync stopped partway, starting over\n", label)
+	}
+	if s.existing, s.etag, err = kvs.FetchExistingKeys(ctx, s.counter, arn, cfg.MaxRetries); err != nil {
+		return nil, fmt.Errorf("fetching existing %s: %w", strings.ToLower(label), err)
 	}
+	if err := s.replan(cfg); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
 
-	// Step 7: Sync headers KVS
-	fmt.Fprintf(os.Stderr, "Syncing headers KVS...\n")
-	headersCounter := &kvs.CountingKVSClient{Client: kvsClient}
-	existingHeaders, headerEtag, err := kvs.FetchExistingKeys(ctx, headersCounter, headersARN, cfg.MaxRetries)
+// replan plans the sync from what the KVS holds now, and checks the plan
+// against the configured delete limit.
+func (s *storeSync) replan(cfg config) error {
+	plan, err := planSync(cfg, s.data, s.existing)
 	if err != nil {
-		fatal("fetching existing headers: %v", err)
+		return fmt.Errorf("syncing %s: %w", strings.ToLower(s.label), err)
 	}
-	headerPlan := kvs.ComputeSyncPlan(headerData, existingHeaders)
-	fmt.Fprintf(os.Stderr, "Headers: %d puts, %d deletes\n", len(headerPlan.Puts), len(headerPlan.Deletes))
-	if err := kvs.Sync(ctx, headersCounter, headersARN, headerEtag, headerPlan, cfg.MaxRetries); err != nil {
-		fatal("syncing headers: %v", err)
+	s.plan = plan
+	if err := checkDeletes(cfg, s.label, s.plan, len(s.existing)); err != nil {
+		return fmt.Errorf("syncing %s: %w (check output-dir, or pass --allow-mass-delete)", strings.ToLower(s.label), err)
 	}
+	return nil
+}
 
-	// Step 8: Deploy CloudFront Functions
-	fmt.Fprintf(os.Stderr, "Deploying viewer-request function...\n")
-	requestCode := functions.BuildFunctionCode(functions.ViewerRequestJS, functions.KVSIDFromARN(redirectsARN), false)
-	if err := functions.DeployFunction(ctx, cfClient, cfg.ViewerRequestName, requestCode, redirectsARN, cfg.MaxRetries); err != nil {
-		fatal("deploying viewer-request function: %v", err)
+// run applies the plan and returns the number of KVS API calls the sync
+// took, planning included. If the KVS changes during the sync, it reports
+// which keys changed, re-fetches the KVS and plans the remaining work again,
+// up to maxSyncConflicts times.
+//
+// Unless snapshots are off, it saves a snapshot of the KVS before changing
+// it, and only if the plan changes something, so a sync that changes
+// nothing doesn't replace a useful one.
+//
+// With track-ownership, it also writes the ownership manifest, and deletes
+// only keys the manifest it replaces recorded. The manifest it writes
+// before the deletes records both the old and the new keys; the exact one
+// goes last (see kvs.SyncPlan.StageManifest).
+func (s *storeSync) run(ctx context.Context, cfg config) (int, error) {
+	label, journal := s.label, s.journal
+	if journal == nil {
+		if ops(s.plan) > 0 {
+			if err := saveSnapshot(cfg, label, s.arn, s.etag, s.existing); err != nil {
+				return s.counter.Calls, err
+			}
+		}
 	}
 
-	fmt.Fprintf(os.Stderr, "Deploying viewer-response function...\n")
-	responseCode := functions.BuildFunctionCode(functions.ViewerResponseJS, functions.KVSIDFromARN(headersARN), cfg.DebugHeaders)
-	if err := functions.DeployFunction(ctx, cfClient, cfg.ViewerResponseName, responseCode, headersARN, cfg.MaxRetries); err != nil {
-		fatal("deploying viewer-response function: %v", err)
+	for conflicts := 0; ; conflicts++ {
+		if journal == nil {
+			var err error
+			journal, err = kvs.NewJournal(s.journalPath, s.arn, s.data, s.plan, s.etag)
+			if err != nil {
+				return s.counter.Calls, err
+			}
+		}
+		puts, deletes := s.plan.Size()
+		fmt.Fprintf(os.Stderr, "%s: %d puts, %d deletes\n", label, puts, deletes)
+		printUnmanaged(label, s.plan)
+		err := kvs.Sync(ctx, s.counter, s.arn, s.etag, s.plan, cfg.MaxRetries, journal)
+		var conflict *kvs.ConflictError
+		if !errors.As(err, &conflict) || conflicts >= maxSyncConflicts {
+			if errors.Is(err, context.Canceled) {
+				return s.counter.Calls, fmt.Errorf("syncing %s: %w (run deploy again to resume)", strings.ToLower(label), err)
+			}
+			if err != nil {
+				return s.counter.Calls, fmt.Errorf("syncing %s: %w", strings.ToLower(label), err)
+			}
+			if err := journal.Remove(); err != nil {
+				return s.counter.Calls, err
+			}
+			return s.counter.Calls, nil
+		}
+
+		// Compare what we expected the KVS to hold with what it holds now.
+		// A resumed sync never listed the KVS, so it can't tell.
+		var expected map[string]string
+		if s.existing != nil {
+			expected = kvs.ApplyPlan(s.existing, conflict.Applied)
+		}
+		s.existing, s.etag, err = kvs.FetchExistingKeys(ctx, s.counter, s.arn, cfg.MaxRetries)
+		if err != nil {
+			return s.counter.Calls, fmt.Errorf("fetching existing %s: %w", strings.ToLower(label), err)
+		}
+		if expected != nil {
+			changed := kvs.ChangedKeys(expected, s.existing)
+			appliedPuts, appliedDeletes := conflict.Applied.Size()
+			fmt.Fprintf(os.Stderr, "%s KVS changed during sync, after %d puts and %d deletes; %d keys changed underneath us (attempt %d/%d):\n",
+				label, appliedPuts, appliedDeletes, len(changed), conflicts+1, maxSyncConflicts)
+			printKeys(changed)
+		} else {
+			fmt.Fprintf(os.Stderr, "%s KVS changed during the resumed sync (attempt %d/%d)\n", label, conflicts+1, maxSyncConflicts)
+		}
+		fmt.Fprintf(os.Stderr, "%s: planning the remaining changes again...\n", label)
+		if err := s.replan(cfg); err != nil {
+			return s.counter.Calls, err
+		}
+		journal = nil
 	}
+}
 
-	fmt.Fprintf(os.Stderr, "\nKVS API calls:\n")
-	fmt.Fprintf(os.Stderr, "  Redirects KVS: %d\n", redirectsCounter.Calls)
-	fmt.Fprintf(os.Stderr, "  Headers KVS:   %d\n", headersCounter.Calls)
-	fmt.Fprintf(os.Stderr, "\nDeploy complete.\n")
+// interruptContext returns a context that the first Ctrl-C cancels, so a
+// sync can stop cleanly after the batch in flight. A second Ctrl-C exits
+// right away.
+func interruptContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	go func() {
+		<-sigs
+		signal.Stop(sigs)
+		fmt.Fprintf(os.Stderr, "\nInterrupted, stopping after the current batch (Ctrl-C again to exit now)...\n")
+		cancel()
+	}()
+	return ctx
+}
+
+// printKeys prints up to maxListedKeys keys, and how many more there are.
+func printKeys(keys []string) {
+	for i, k := range keys {
+		if i == maxListedKeys {
+			fmt.Fprintf(os.Stderr, "  ...and %d more\n", len(keys)-maxListedKeys)
+			break
+		}
+		fmt.Fprintf(os.Stderr, "  %s\n", k)
+	}
 }
 
 func loadConfig(path string) config {
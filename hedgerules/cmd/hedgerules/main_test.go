@@ -1,9 +1,12 @@
 package main
 
 import (
+	"errors"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestResolveAtFile_PlainValue(t *testing.T) {
@@ -38,3 +41,38 @@ func TestResolveAtFile_MissingFile(t *testing.T) {
 		t.Fatal("expected error for nonexistent file, got nil")
 	}
 }
+
+func TestParallel_Limit(t *testing.T) {
+	var running, peak int32
+	task := func() error {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		return nil
+	}
+	if err := parallel(2, task, task, task, task, task); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if peak > 2 {
+		t.Errorf("expected at most 2 tasks at once, got %d", peak)
+	}
+}
+
+func TestParallel_JoinsErrors(t *testing.T) {
+	errA := errors.New("redirects failed")
+	errB := errors.New("headers failed")
+	err := parallel(2,
+		func() error { return errA },
+		func() error { return nil },
+		func() error { return errB },
+	)
+	if !errors.Is(err, errA) || !errors.Is(err, errB) {
+		t.Errorf("expected both errors, got %v", err)
+	}
+}
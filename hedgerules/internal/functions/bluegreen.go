@@ -0,0 +1,57 @@
+package functions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudfront"
+	cftypes "github.com/aws/aws-sdk-go-v2/service/cloudfront/types"
+	"github.com/mrled/hedgerules/hedgerules/internal/retry"
+)
+
+// BlueGreenNames returns the names of the two stores a blue/green deploy
+// alternates between in place of the KVS called name.
+func BlueGreenNames(name string) (blue, green string) {
+	return name + "-blue", name + "-green"
+}
+
+// Standby returns the ARN of the blue or green store that a function is not
+// using, given the ARN of the one it is using. A function that uses neither,
+// as before its first blue/green deploy, gets blue.
+func Standby(live, blue, green string) string {
+	if live == blue {
+		return green
+	}
+	return blue
+}
+
+// LiveKVSARN returns the ARN of the KVS associated with the LIVE stage of a
+// CloudFront Function, or "" if the function has not been published or has
+// no KVS.
+func LiveKVSARN(ctx context.Context, client CFClient, name string, maxRetries int) (string, error) {
+	var resp *cloudfront.DescribeFunctionOutput
+	err := retry.Do(maxRetries, func() error {
+		var e error
+		resp, e = client.DescribeFunction(ctx, &cloudfront.DescribeFunctionInput{
+			Name:  &name,
+			Stage: cftypes.FunctionStageLive,
+		})
+		return e
+	})
+	var notFound *cftypes.NoSuchFunctionExists
+	if errors.As(err, &notFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("describing function %s: %w", name, err)
+	}
+	if resp.FunctionSummary == nil || resp.FunctionSummary.FunctionConfig == nil {
+		return "", nil
+	}
+	assoc := resp.FunctionSummary.FunctionConfig.KeyValueStoreAssociations
+	if assoc == nil || len(assoc.Items) == 0 || assoc.Items[0].KeyValueStoreARN == nil {
+		return "", nil
+	}
+	return *assoc.Items[0].KeyValueStoreARN, nil
+}
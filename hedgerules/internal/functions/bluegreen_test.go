@@ -0,0 +1,26 @@
+package functions
+
+import "testing"
+
+func TestBlueGreenNames(t *testing.T) {
+	blue, green := BlueGreenNames("mysite-redirects")
+	if blue != "mysite-redirects-blue" || green != "mysite-redirects-green" {
+		t.Errorf("got %q, %q", blue, green)
+	}
+}
+
+func TestStandby(t *testing.T) {
+	tests := []struct {
+		live, want string
+	}{
+		{"arn:blue", "arn:green"},
+		{"arn:green", "arn:blue"},
+		{"", "arn:blue"},
+		{"arn:other", "arn:blue"},
+	}
+	for _, tt := range tests {
+		if got := Standby(tt.live, "arn:blue", "arn:green"); got != tt.want {
+			t.Errorf("Standby(%q) = %q, want %q", tt.live, got, tt.want)
+		}
+	}
+}
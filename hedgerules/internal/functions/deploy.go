@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
 	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/service/cloudfront"
@@ -23,6 +24,7 @@ func KVSIDFromARN(arn string) string {
 // CFClient abstracts the CloudFront Functions API.
 type CFClient interface {
 	DescribeFunction(ctx context.Context, params *cloudfront.DescribeFunctionInput, optFns ...func(*cloudfront.Options)) (*cloudfront.DescribeFunctionOutput, error)
+	GetFunction(ctx context.Context, params *cloudfront.GetFunctionInput, optFns ...func(*cloudfront.Options)) (*cloudfront.GetFunctionOutput, error)
 	CreateFunction(ctx context.Context, params *cloudfront.CreateFunctionInput, optFns ...func(*cloudfront.Options)) (*cloudfront.CreateFunctionOutput, error)
 	UpdateFunction(ctx context.Context, params *cloudfront.UpdateFunctionInput, optFns ...func(*cloudfront.Options)) (*cloudfront.UpdateFunctionOutput, error)
 	PublishFunction(ctx context.Context, params *cloudfront.PublishFunctionInput, optFns ...func(*cloudfront.Options)) (*cloudfront.PublishFunctionOutput, error)
@@ -35,8 +37,25 @@ type KVSARNResolver interface {
 
 // ResolveKVSARN resolves a KVS name to its ARN by listing all KVS and matching by name.
 func ResolveKVSARN(ctx context.Context, client KVSARNResolver, kvsName string, maxRetries int) (string, error) {
+	arns, err := ResolveKVSARNs(ctx, client, []string{kvsName}, maxRetries)
+	if err != nil {
+		return "", err
+	}
+	return arns[kvsName], nil
+}
+
+// ResolveKVSARNs resolves several KVS names to their ARNs with a single
+// listing of all KVS, stopping once every name is found. It fails if any
+// name is not found.
+func ResolveKVSARNs(ctx context.Context, client KVSARNResolver, kvsNames []string, maxRetries int) (map[string]string, error) {
+	wanted := make(map[string]bool, len(kvsNames))
+	for _, name := range kvsNames {
+		wanted[name] = true
+	}
+	arns := make(map[string]string, len(wanted))
+
 	var marker *string
-	for {
+	for len(arns) < len(wanted) {
 		var resp *cloudfront.ListKeyValueStoresOutput
 		err := retry.Do(maxRetries, func() error {
 			var e error
@@ -46,14 +65,12 @@ func ResolveKVSARN(ctx context.Context, client KVSARNResolver, kvsName string, m
 			return e
 		})
 		if err != nil {
-			return "", fmt.Errorf("listing key value stores: %w", err)
+			return nil, fmt.Errorf("listing key value stores: %w", err)
 		}
 		if resp.KeyValueStoreList != nil {
 			for _, item := range resp.KeyValueStoreList.Items {
-				if item.Name != nil && *item.Name == kvsName {
-					if item.ARN != nil {
-						return *item.ARN, nil
-					}
+				if item.Name != nil && wanted[*item.Name] && item.ARN != nil {
+					arns[*item.Name] = *item.ARN
 				}
 			}
 			marker = resp.KeyValueStoreList.NextMarker
@@ -62,22 +79,96 @@ func ResolveKVSARN(ctx context.Context, client KVSARNResolver, kvsName string, m
 			break
 		}
 	}
-	return "", fmt.Errorf("key value store not found: %s", kvsName)
+
+	var missing []string
+	for name := range wanted {
+		if _, ok := arns[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return nil, fmt.Errorf("key value store not found: %s", strings.Join(missing, ", "))
+	}
+	return arns, nil
 }
 
 // DeployFunction creates or updates a CloudFront Function with the given
 // JS source code and KVS association. It publishes the function to LIVE stage.
 func DeployFunction(ctx context.Context, client CFClient, name string, code []byte, kvsARN string, maxRetries int) error {
+	etag, err := StageFunction(ctx, client, name, code, kvsARN, maxRetries)
+	if err != nil {
+		return err
+	}
+	return PublishFunction(ctx, client, name, etag, maxRetries)
+}
+
+// Deployment is the code and KVS association to deploy a CloudFront Function
+// with.
+type Deployment struct {
+	Name   string
+	Code   []byte
+	KVSARN string
+}
+
+// DeployFunctions deploys CloudFront Functions that must change together.
+// It stages every function before publishing any, so a failed update leaves
+// them all as they were. If publishing one fails, it publishes the previous
+// LIVE code of the ones already published again. The publishes themselves
+// still happen one after the other, so for the moment between them viewers
+// get a mix of old and new functions.
+func DeployFunctions(ctx context.Context, client CFClient, deployments []Deployment, maxRetries int) error {
+	previous := make([]*Deployment, len(deployments))
+	etags := make([]string, len(deployments))
+	for i, d := range deployments {
+		code, kvsARN, err := LiveFunction(ctx, client, d.Name, maxRetries)
+		if err != nil {
+			return err
+		}
+		if code != nil {
+			previous[i] = &Deployment{Name: d.Name, Code: code, KVSARN: kvsARN}
+		}
+		if etags[i], err = StageFunction(ctx, client, d.Name, d.Code, d.KVSARN, maxRetries); err != nil {
+			return err
+		}
+	}
+
+	for i, d := range deployments {
+		err := PublishFunction(ctx, client, d.Name, etags[i], maxRetries)
+		if err == nil {
+			continue
+		}
+		for j, p := range previous[:i] {
+			if p == nil {
+				err = errors.Join(err, fmt.Errorf("function %s was not published before, so it can't be rolled back", deployments[j].Name))
+				continue
+			}
+			if rbErr := DeployFunction(ctx, client, p.Name, p.Code, p.KVSARN, maxRetries); rbErr != nil {
+				err = errors.Join(err, fmt.Errorf("rolling back function %s: %w", p.Name, rbErr))
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// StageFunction creates or updates the DEVELOPMENT stage of a CloudFront
+// Function with the given JS source code and KVS association, and returns
+// the ETag to publish it with. Viewers keep getting the LIVE stage until
+// it is published.
+func StageFunction(ctx context.Context, client CFClient, name string, code []byte, kvsARN string, maxRetries int) (string, error) {
 	runtime := cftypes.FunctionRuntimeCloudfrontJs20
-	kvAssoc := &cftypes.KeyValueStoreAssociations{
-		Quantity: int32Ptr(1),
-		Items: []cftypes.KeyValueStoreAssociation{
-			{KeyValueStoreARN: &kvsARN},
-		},
+	kvAssoc := &cftypes.KeyValueStoreAssociations{Quantity: int32Ptr(0)}
+	if kvsARN != "" {
+		kvAssoc = &cftypes.KeyValueStoreAssociations{
+			Quantity: int32Ptr(1),
+			Items: []cftypes.KeyValueStoreAssociation{
+				{KeyValueStoreARN: &kvsARN},
+			},
+		}
 	}
 
 	// Check if function already exists
-	var etag string
 	var descResp *cloudfront.DescribeFunctionOutput
 	err := retry.Do(maxRetries, func() error {
 		var e error
@@ -90,12 +181,12 @@ func DeployFunction(ctx context.Context, client CFClient, name string, code []by
 
 	var notFound *cftypes.NoSuchFunctionExists
 	if err != nil && !errors.As(err, &notFound) {
-		return fmt.Errorf("describing function %s: %w", name, err)
+		return "", fmt.Errorf("describing function %s: %w", name, err)
 	}
 
 	if descResp != nil && descResp.ETag != nil {
 		// Function exists, update it
-		etag = *descResp.ETag
+		etag := *descResp.ETag
 		var updateResp *cloudfront.UpdateFunctionOutput
 		err := retry.Do(maxRetries, func() error {
 			var e error
@@ -112,35 +203,37 @@ func DeployFunction(ctx context.Context, client CFClient, name string, code []by
 			return e
 		})
 		if err != nil {
-			return fmt.Errorf("updating function %s: %w", name, err)
-		}
-		etag = *updateResp.ETag
-	} else {
-		// Function doesn't exist, create it
-		var createResp *cloudfront.CreateFunctionOutput
-		err := retry.Do(maxRetries, func() error {
-			var e error
-			createResp, e = client.CreateFunction(ctx, &cloudfront.CreateFunctionInput{
-				Name:         &name,
-				FunctionCode: code,
-				FunctionConfig: &cftypes.FunctionConfig{
-					Comment:                   strPtr(fmt.Sprintf("Managed by hedgerules: %s", name)),
-					Runtime:                   runtime,
-					KeyValueStoreAssociations: kvAssoc,
-				},
-			})
-			return e
-		})
-		if err != nil {
-			return fmt.Errorf("creating function %s: %w", name, err)
+			return "", fmt.Errorf("updating function %s: %w", name, err)
 		}
-		etag = *createResp.ETag
+		return *updateResp.ETag, nil
 	}
 
-	// Publish to LIVE stage
+	// Function doesn't exist, create it
+	var createResp *cloudfront.CreateFunctionOutput
 	err = retry.Do(maxRetries, func() error {
 		var e error
-		_, e = client.PublishFunction(ctx, &cloudfront.PublishFunctionInput{
+		createResp, e = client.CreateFunction(ctx, &cloudfront.CreateFunctionInput{
+			Name:         &name,
+			FunctionCode: code,
+			FunctionConfig: &cftypes.FunctionConfig{
+				Comment:                   strPtr(fmt.Sprintf("Managed by hedgerules: %s", name)),
+				Runtime:                   runtime,
+				KeyValueStoreAssociations: kvAssoc,
+			},
+		})
+		return e
+	})
+	if err != nil {
+		return "", fmt.Errorf("creating function %s: %w", name, err)
+	}
+	return *createResp.ETag, nil
+}
+
+// PublishFunction publishes the DEVELOPMENT stage of a CloudFront Function,
+// as StageFunction left it with etag, to LIVE.
+func PublishFunction(ctx context.Context, client CFClient, name, etag string, maxRetries int) error {
+	err := retry.Do(maxRetries, func() error {
+		_, e := client.PublishFunction(ctx, &cloudfront.PublishFunctionInput{
 			Name:    &name,
 			IfMatch: &etag,
 		})
@@ -149,9 +242,35 @@ func DeployFunction(ctx context.Context, client CFClient, name string, code []by
 	if err != nil {
 		return fmt.Errorf("publishing function %s: %w", name, err)
 	}
-
 	return nil
 }
 
+// LiveFunction returns the code of the LIVE stage of a CloudFront Function
+// and the ARN of its KVS, or nil code if the function has not been
+// published.
+func LiveFunction(ctx context.Context, client CFClient, name string, maxRetries int) ([]byte, string, error) {
+	var resp *cloudfront.GetFunctionOutput
+	err := retry.Do(maxRetries, func() error {
+		var e error
+		resp, e = client.GetFunction(ctx, &cloudfront.GetFunctionInput{
+			Name:  &name,
+			Stage: cftypes.FunctionStageLive,
+		})
+		return e
+	})
+	var notFound *cftypes.NoSuchFunctionExists
+	if errors.As(err, &notFound) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("getting function %s: %w", name, err)
+	}
+	kvsARN, err := LiveKVSARN(ctx, client, name, maxRetries)
+	if err != nil {
+		return nil, "", err
+	}
+	return resp.FunctionCode, kvsARN, nil
+}
+
 func strPtr(s string) *string { return &s }
 func int32Ptr(i int32) *int32 { return &i }
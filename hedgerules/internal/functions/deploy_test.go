@@ -0,0 +1,153 @@
+package functions
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudfront"
+	cftypes "github.com/aws/aws-sdk-go-v2/service/cloudfront/types"
+)
+
+// mockResolver lists stores named in pages, one page per call.
+type mockResolver struct {
+	pages [][]string
+	calls int
+}
+
+func (m *mockResolver) ListKeyValueStores(ctx context.Context, params *cloudfront.ListKeyValueStoresInput, optFns ...func(*cloudfront.Options)) (*cloudfront.ListKeyValueStoresOutput, error) {
+	page := m.calls
+	m.calls++
+	list := &cftypes.KeyValueStoreList{}
+	for _, name := range m.pages[page] {
+		name, arn := name, "arn:aws:cloudfront::123:key-value-store/"+name
+		list.Items = append(list.Items, cftypes.KeyValueStore{Name: &name, ARN: &arn})
+	}
+	if page+1 < len(m.pages) {
+		list.NextMarker = strPtr(fmt.Sprint(page + 1))
+	}
+	return &cloudfront.ListKeyValueStoresOutput{KeyValueStoreList: list}, nil
+}
+
+func TestResolveKVSARNs(t *testing.T) {
+	m := &mockResolver{pages: [][]string{{"other", "site-redirects"}, {"site-headers"}, {"more"}}}
+	arns, err := ResolveKVSARNs(context.Background(), m, []string{"site-redirects", "site-headers"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if arns["site-headers"] != "arn:aws:cloudfront::123:key-value-store/site-headers" || len(arns) != 2 {
+		t.Errorf("unexpected ARNs %v", arns)
+	}
+	if m.calls != 2 {
+		t.Errorf("expected listing to stop after 2 pages, got %d", m.calls)
+	}
+}
+
+func TestResolveKVSARNs_Missing(t *testing.T) {
+	m := &mockResolver{pages: [][]string{{"site-redirects"}, {"other"}}}
+	_, err := ResolveKVSARNs(context.Background(), m, []string{"site-redirects", "site-headers", "site-extra"}, 0)
+	if err == nil || !strings.Contains(err.Error(), "site-extra, site-headers") {
+		t.Errorf("expected error naming both missing stores, got %v", err)
+	}
+}
+
+// mockFunction is a CloudFront Function's DEVELOPMENT and LIVE stages.
+type mockFunction struct {
+	devCode, liveCode []byte
+	devARN, liveARN   string
+}
+
+// mockCF keeps functions in memory, failing to publish failPublish.
+type mockCF struct {
+	funcs       map[string]*mockFunction
+	failPublish string
+}
+
+func (m *mockCF) DescribeFunction(ctx context.Context, params *cloudfront.DescribeFunctionInput, optFns ...func(*cloudfront.Options)) (*cloudfront.DescribeFunctionOutput, error) {
+	f := m.funcs[*params.Name]
+	if f == nil || params.Stage == cftypes.FunctionStageLive && f.liveCode == nil {
+		return nil, &cftypes.NoSuchFunctionExists{}
+	}
+	arn := f.devARN
+	if params.Stage == cftypes.FunctionStageLive {
+		arn = f.liveARN
+	}
+	return &cloudfront.DescribeFunctionOutput{
+		ETag: strPtr("etag"),
+		FunctionSummary: &cftypes.FunctionSummary{FunctionConfig: &cftypes.FunctionConfig{
+			KeyValueStoreAssociations: &cftypes.KeyValueStoreAssociations{
+				Items: []cftypes.KeyValueStoreAssociation{{KeyValueStoreARN: &arn}},
+			},
+		}},
+	}, nil
+}
+
+func (m *mockCF) GetFunction(ctx context.Context, params *cloudfront.GetFunctionInput, optFns ...func(*cloudfront.Options)) (*cloudfront.GetFunctionOutput, error) {
+	f := m.funcs[*params.Name]
+	if f == nil || f.liveCode == nil {
+		return nil, &cftypes.NoSuchFunctionExists{}
+	}
+	return &cloudfront.GetFunctionOutput{FunctionCode: f.liveCode}, nil
+}
+
+func (m *mockCF) CreateFunction(ctx context.Context, params *cloudfront.CreateFunctionInput, optFns ...func(*cloudfront.Options)) (*cloudfront.CreateFunctionOutput, error) {
+	m.funcs[*params.Name] = &mockFunction{}
+	m.stage(*params.Name, params.FunctionCode, params.FunctionConfig)
+	return &cloudfront.CreateFunctionOutput{ETag: strPtr("etag")}, nil
+}
+
+func (m *mockCF) UpdateFunction(ctx context.Context, params *cloudfront.UpdateFunctionInput, optFns ...func(*cloudfront.Options)) (*cloudfront.UpdateFunctionOutput, error) {
+	m.stage(*params.Name, params.FunctionCode, params.FunctionConfig)
+	return &cloudfront.UpdateFunctionOutput{ETag: strPtr("etag")}, nil
+}
+
+func (m *mockCF) stage(name string, code []byte, cfg *cftypes.FunctionConfig) {
+	f := m.funcs[name]
+	f.devCode, f.devARN = code, *cfg.KeyValueStoreAssociations.Items[0].KeyValueStoreARN
+}
+
+func (m *mockCF) PublishFunction(ctx context.Context, params *cloudfront.PublishFunctionInput, optFns ...func(*cloudfront.Options)) (*cloudfront.PublishFunctionOutput, error) {
+	if *params.Name == m.failPublish {
+		return nil, fmt.Errorf("publish failed")
+	}
+	f := m.funcs[*params.Name]
+	f.liveCode, f.liveARN = f.devCode, f.devARN
+	return &cloudfront.PublishFunctionOutput{}, nil
+}
+
+func TestDeployFunctions(t *testing.T) {
+	m := &mockCF{funcs: map[string]*mockFunction{
+		"req": {devCode: []byte("old req"), liveCode: []byte("old req"), devARN: "blue", liveARN: "blue"},
+	}}
+	deployments := []Deployment{{"req", []byte("new req"), "green"}, {"resp", []byte("new resp"), "green"}}
+	if err := DeployFunctions(context.Background(), m, deployments, 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"req", "resp"} {
+		if f := m.funcs[name]; string(f.liveCode) != "new "+name || f.liveARN != "green" {
+			t.Errorf("%s: expected new code with green live, got %q with %s", name, f.liveCode, f.liveARN)
+		}
+	}
+}
+
+func TestDeployFunctions_RollsBack(t *testing.T) {
+	m := &mockCF{
+		funcs: map[string]*mockFunction{
+			"req":  {devCode: []byte("old req"), liveCode: []byte("old req"), devARN: "blue", liveARN: "blue"},
+			"resp": {devCode: []byte("old resp"), liveCode: []byte("old resp"), devARN: "blue", liveARN: "blue"},
+		},
+		failPublish: "resp",
+	}
+	deployments := []Deployment{{"req", []byte("new req"), "green"}, {"resp", []byte("new resp"), "green"}}
+	err := DeployFunctions(context.Background(), m, deployments, 0)
+	if err == nil || !strings.Contains(err.Error(), "publishing function resp") {
+		t.Fatalf("expected publish error, got %v", err)
+	}
+	// The function published first goes back to what was live before
+	for _, name := range []string{"req", "resp"} {
+		if f := m.funcs[name]; string(f.liveCode) != "old "+name || f.liveARN != "blue" {
+			t.Errorf("%s: expected old code with blue live, got %q with %s", name, f.liveCode, f.liveARN)
+		}
+	}
+}
@@ -2,7 +2,9 @@ package functions
 
 import (
 	_ "embed"
+	"encoding/json"
 	"fmt"
+	"strings"
 )
 
 //go:embed viewer-request.js
@@ -11,9 +13,56 @@ var ViewerRequestJS []byte
 //go:embed viewer-response.js
 var ViewerResponseJS []byte
 
+// Vars holds the values injected as JS variables ahead of a function's source.
+type Vars struct {
+	KVSID        string
+	DebugHeaders bool
+
+	// KeyPrefix is prepended to every KVS key the function looks up, when
+	// one KVS holds both redirects and headers (see kvs.RedirectsPrefix);
+	// empty omits the variable.
+	KeyPrefix string
+
+	// QueryPolicies is only used by viewer-request.js; nil omits the variable.
+	QueryPolicies []QueryPolicy
+
+	// CompiledHeaders is only used by viewer-response.js; false omits the
+	// variable, leaving the function in cascade mode.
+	CompiledHeaders bool
+
+	// ScopedGlobs is only used by viewer-response.js, and turns on the
+	// directory-scoped extension lookup (see headers.HasScopedGlobs); false
+	// omits the variable.
+	ScopedGlobs bool
+}
+
 // BuildFunctionCode prepends injected variables to the JS source.
-// It injects the KVS ID and the debug headers toggle.
-func BuildFunctionCode(jsSource []byte, kvsID string, debugHeaders bool) []byte {
-	header := fmt.Sprintf("var kvsId = '%s';\nvar debugHeaders = %v;\n", kvsID, debugHeaders)
-	return append([]byte(header), jsSource...)
+// It always injects the KVS ID and the debug headers toggle; optional
+// variables are only injected when set.
+func BuildFunctionCode(jsSource []byte, vars Vars) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "var kvsId = '%s';\nvar debugHeaders = %v;\n", vars.KVSID, vars.DebugHeaders)
+	if vars.KeyPrefix != "" {
+		fmt.Fprintf(&b, "var kvsPrefix = %s;\n", mustJSON(vars.KeyPrefix))
+	}
+	if vars.QueryPolicies != nil {
+		fmt.Fprintf(&b, "var queryPolicies = %s;\n", mustJSON(vars.QueryPolicies))
+	}
+	if vars.CompiledHeaders {
+		b.WriteString("var compiledHeaders = true;\n")
+	}
+	if vars.ScopedGlobs {
+		b.WriteString("var scopedGlobs = true;\n")
+	}
+	return append([]byte(b.String()), jsSource...)
+}
+
+// mustJSON encodes v as a JS literal. Injected values are plain structs that
+// always marshal, so an error here is a programming mistake.
+func mustJSON(v any) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(fmt.Sprintf("encoding injected variable: %v", err))
+	}
+	return string(data)
 }
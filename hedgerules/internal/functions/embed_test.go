@@ -16,6 +16,32 @@ func TestViewerRequestJSEmbedded(t *testing.T) {
 	if !strings.Contains(content, "kvs.get") {
 		t.Error("ViewerRequestJS missing KVS lookup")
 	}
+	if !strings.Contains(content, "if (!isNotFound(err))") {
+		t.Error("ViewerRequestJS records missing keys as lookup errors")
+	}
+	if !strings.Contains(content, "x-hedgerules-request-key") {
+		t.Error("ViewerRequestJS missing debug header x-hedgerules-request-key")
+	}
+	if !strings.Contains(content, "debugHeaders") {
+		t.Error("ViewerRequestJS missing debugHeaders conditional")
+	}
+}
+
+func TestViewerRequestJSDropsSpoofedDebugHeaders(t *testing.T) {
+	// A client sending x-hedgerules-request-error must not have it reflected
+	// by viewer-response as if viewer-request set it, debug or not
+	content := string(ViewerRequestJS)
+	handler := content[strings.Index(content, "async function handler"):]
+	remove := strings.Index(handler, "removeDebugHeaders(request.headers);")
+	if remove == -1 {
+		t.Fatal("ViewerRequestJS doesn't remove incoming x-hedgerules-request-* headers")
+	}
+	if debug := strings.Index(handler, "if (debug)"); remove > debug {
+		t.Error("ViewerRequestJS removes incoming debug headers only after setting its own")
+	}
+	if !strings.Contains(content, "if (names[i].startsWith('x-hedgerules-request-')) {\n      delete headers[names[i]];") {
+		t.Error("removeDebugHeaders doesn't delete x-hedgerules-request-* headers")
+	}
 }
 
 func TestViewerResponseJSEmbedded(t *testing.T) {
@@ -29,8 +55,8 @@ func TestViewerResponseJSEmbedded(t *testing.T) {
 	if !strings.Contains(content, "kvs.get") {
 		t.Error("ViewerResponseJS missing KVS lookup")
 	}
-	if !strings.Contains(content, "{/path}") {
-		t.Error("ViewerResponseJS missing {/path} token substitution")
+	if !strings.Contains(content, "expandTokens") {
+		t.Error("ViewerResponseJS missing request token expansion")
 	}
 	if !strings.Contains(content, "x-hedgerules-patterns") {
 		t.Error("ViewerResponseJS missing debug header x-hedgerules-patterns")
@@ -44,13 +70,28 @@ func TestViewerResponseJSEmbedded(t *testing.T) {
 	if !strings.Contains(content, "debugHeaders") {
 		t.Error("ViewerResponseJS missing debugHeaders conditional")
 	}
+	if !strings.Contains(content, "x-hedgerules-request-") {
+		t.Error("ViewerResponseJS missing copy of viewer-request debug headers")
+	}
+	if !strings.Contains(content, "'*.' + ext") {
+		t.Error("ViewerResponseJS missing directory-scoped extension lookup")
+	}
+	if !strings.Contains(content, "typeof compiledHeaders !== 'undefined'") {
+		t.Error("ViewerResponseJS missing compiledHeaders conditional")
+	}
+	if !strings.Contains(content, "value.charAt(0) === '@'") {
+		t.Error("ViewerResponseJS missing header set reference lookup")
+	}
+	if !strings.Contains(content, "delete response.headers") {
+		t.Error("ViewerResponseJS missing header removal")
+	}
 }
 
 func TestBuildFunctionCode(t *testing.T) {
 	js := []byte("function handler() {}")
 	kvsID := "arn:aws:cloudfront::123:key-value-store/abc"
 
-	result := BuildFunctionCode(js, kvsID, false)
+	result := BuildFunctionCode(js, Vars{KVSID: kvsID})
 	code := string(result)
 
 	if !strings.HasPrefix(code, "var kvsId = '"+kvsID+"';") {
@@ -62,13 +103,19 @@ func TestBuildFunctionCode(t *testing.T) {
 	if !strings.Contains(code, "function handler() {}") {
 		t.Error("original JS code missing from result")
 	}
+	if strings.Contains(code, "queryPolicies") {
+		t.Error("expected queryPolicies to be omitted when unset")
+	}
+	if strings.Contains(code, "compiledHeaders") {
+		t.Error("expected compiledHeaders to be omitted when unset")
+	}
 }
 
 func TestBuildFunctionCode_DebugEnabled(t *testing.T) {
 	js := []byte("function handler() {}")
 	kvsID := "arn:aws:cloudfront::123:key-value-store/abc"
 
-	result := BuildFunctionCode(js, kvsID, true)
+	result := BuildFunctionCode(js, Vars{KVSID: kvsID, DebugHeaders: true})
 	code := string(result)
 
 	if !strings.Contains(code, "var debugHeaders = true;") {
@@ -78,3 +125,74 @@ func TestBuildFunctionCode_DebugEnabled(t *testing.T) {
 		t.Error("expected kvsId variable")
 	}
 }
+
+func TestBuildFunctionCode_QueryPolicies(t *testing.T) {
+	js := []byte("function handler() {}")
+	policies := []QueryPolicy{{Prefix: "", Mode: QueryModeDeny, Params: []string{"utm_*"}, Sort: true}}
+
+	code := string(BuildFunctionCode(js, Vars{KVSID: "abc", QueryPolicies: policies}))
+
+	want := `var queryPolicies = [{"prefix":"","mode":"deny","params":["utm_*"],"sort":true}];`
+	if !strings.Contains(code, want) {
+		t.Errorf("expected %s, got: %s", want, code)
+	}
+}
+
+func TestViewerRequestJSQueryPolicies(t *testing.T) {
+	content := string(ViewerRequestJS)
+	if !strings.Contains(content, "typeof queryPolicies !== 'undefined'") {
+		t.Error("ViewerRequestJS missing queryPolicies conditional")
+	}
+}
+
+func TestBuildFunctionCode_CompiledHeaders(t *testing.T) {
+	code := string(BuildFunctionCode([]byte("function handler() {}"), Vars{KVSID: "abc", CompiledHeaders: true}))
+	if !strings.Contains(code, "var compiledHeaders = true;") {
+		t.Errorf("expected compiledHeaders = true, got: %s", code)
+	}
+}
+
+func TestBuildFunctionCode_KeyPrefix(t *testing.T) {
+	code := string(BuildFunctionCode([]byte("function handler() {}"), Vars{KVSID: "abc", KeyPrefix: "r:"}))
+	if !strings.Contains(code, `var kvsPrefix = "r:";`) {
+		t.Errorf("expected kvsPrefix = \"r:\", got: %s", code)
+	}
+
+	code = string(BuildFunctionCode([]byte("function handler() {}"), Vars{KVSID: "abc"}))
+	if strings.Contains(code, "kvsPrefix") {
+		t.Error("expected kvsPrefix to be omitted when unset")
+	}
+}
+
+func TestJSKeyPrefix(t *testing.T) {
+	if !strings.Contains(string(ViewerRequestJS), "kvs.get(storeKey(prefix + uri))") {
+		t.Error("ViewerRequestJS missing prefixed redirect lookup")
+	}
+	if !strings.Contains(string(ViewerResponseJS), "kvs.get(storeKey(prefix + key))") {
+		t.Error("ViewerResponseJS missing prefixed header lookup")
+	}
+}
+
+func TestJSLongKeys(t *testing.T) {
+	for name, js := range map[string][]byte{"ViewerRequestJS": ViewerRequestJS, "ViewerResponseJS": ViewerResponseJS} {
+		if !strings.Contains(string(js), "function storeKey") {
+			t.Errorf("%s missing long key hashing", name)
+		}
+		if !strings.Contains(string(js), "var maxKeyBytes = 512;") {
+			t.Errorf("%s missing maxKeyBytes", name)
+		}
+	}
+}
+
+func TestBuildFunctionCode_ScopedGlobs(t *testing.T) {
+	if code := string(BuildFunctionCode(nil, Vars{KVSID: "abc"})); strings.Contains(code, "scopedGlobs") {
+		t.Errorf("expected scopedGlobs to be omitted when unset, got: %s", code)
+	}
+	code := string(BuildFunctionCode(nil, Vars{KVSID: "abc", ScopedGlobs: true}))
+	if !strings.Contains(code, "var scopedGlobs = true;") {
+		t.Errorf("expected scopedGlobs = true, got: %s", code)
+	}
+	if !strings.Contains(string(ViewerResponseJS), "typeof scopedGlobs !== 'undefined'") {
+		t.Error("ViewerResponseJS missing scopedGlobs conditional")
+	}
+}
@@ -0,0 +1,118 @@
+package functions
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Query string policy modes understood by viewer-request.js.
+const (
+	QueryModeKeep  = "keep"  // keep every parameter
+	QueryModeStrip = "strip" // drop the whole query string
+	QueryModeAllow = "allow" // keep only the listed parameters
+	QueryModeDeny  = "deny"  // drop the listed parameters
+)
+
+// QueryPolicy describes how the viewer-request function normalizes the query
+// string of requests under Prefix. Params entries ending in '*' match any
+// parameter name with that prefix (e.g. "utm_*").
+type QueryPolicy struct {
+	Prefix string   `toml:"-" json:"prefix"`
+	Mode   string   `toml:"mode" json:"mode"`
+	Params []string `toml:"params" json:"params,omitempty"`
+	Sort   bool     `toml:"sort" json:"sort,omitempty"`
+}
+
+// QueryConfig is the global query string policy plus per-prefix overrides,
+// as read from the [query-string] table of hedgerules.toml.
+type QueryConfig struct {
+	QueryPolicy
+	Prefixes map[string]QueryPolicy `toml:"prefixes"`
+}
+
+// Policies returns the effective policies ordered longest prefix first, so the
+// first policy whose prefix matches a request URI is the one that applies.
+// The global policy has the empty prefix and sorts last; it is omitted when it
+// leaves the query string untouched, so an unconfigured QueryConfig returns nil.
+func (c QueryConfig) Policies() []QueryPolicy {
+	var policies []QueryPolicy
+	for prefix, p := range c.Prefixes {
+		p.Prefix = prefix
+		policies = append(policies, p.normalized())
+	}
+	sort.Slice(policies, func(i, j int) bool {
+		if len(policies[i].Prefix) != len(policies[j].Prefix) {
+			return len(policies[i].Prefix) > len(policies[j].Prefix)
+		}
+		return policies[i].Prefix < policies[j].Prefix
+	})
+	global := c.QueryPolicy.normalized()
+	global.Prefix = ""
+	if !global.passthrough() {
+		policies = append(policies, global)
+	}
+	return policies
+}
+
+// Validate checks the global policy and every prefix override.
+func (c QueryConfig) Validate() error {
+	if err := c.QueryPolicy.validate(); err != nil {
+		return fmt.Errorf("query-string: %w", err)
+	}
+	for prefix, p := range c.Prefixes {
+		if !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("query-string prefix %q: must start with /", prefix)
+		}
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("query-string prefix %q: %w", prefix, err)
+		}
+	}
+	return nil
+}
+
+// String describes the policy for humans, e.g. "deny utm_*, fbclid; sorted".
+func (p QueryPolicy) String() string {
+	p = p.normalized()
+	s := p.Mode
+	if len(p.Params) > 0 {
+		s += " " + strings.Join(p.Params, ", ")
+	}
+	if p.Sort && p.Mode != QueryModeStrip {
+		s += "; sorted"
+	}
+	return s
+}
+
+func (p QueryPolicy) normalized() QueryPolicy {
+	if p.Mode == "" {
+		p.Mode = QueryModeKeep
+	}
+	return p
+}
+
+func (p QueryPolicy) passthrough() bool {
+	return p.Mode == QueryModeKeep && !p.Sort
+}
+
+func (p QueryPolicy) validate() error {
+	switch p.normalized().Mode {
+	case QueryModeKeep, QueryModeStrip:
+		if len(p.Params) > 0 {
+			return fmt.Errorf("params are only used with mode %q or %q", QueryModeAllow, QueryModeDeny)
+		}
+	case QueryModeAllow, QueryModeDeny:
+		if len(p.Params) == 0 {
+			return fmt.Errorf("mode %q requires params", p.Mode)
+		}
+		for _, name := range p.Params {
+			if name == "" || name == "*" {
+				return fmt.Errorf("invalid param pattern %q", name)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown mode %q (want %s, %s, %s, or %s)", p.Mode,
+			QueryModeKeep, QueryModeStrip, QueryModeAllow, QueryModeDeny)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package functions
+
+import (
+	"testing"
+)
+
+func TestQueryConfigPolicies_Unconfigured(t *testing.T) {
+	if policies := (QueryConfig{}).Policies(); policies != nil {
+		t.Errorf("expected nil policies, got %v", policies)
+	}
+}
+
+func TestQueryConfigPolicies_Order(t *testing.T) {
+	cfg := QueryConfig{
+		QueryPolicy: QueryPolicy{Mode: QueryModeDeny, Params: []string{"utm_*", "fbclid"}},
+		Prefixes: map[string]QueryPolicy{
+			"/search/":         {Mode: QueryModeAllow, Params: []string{"q"}, Sort: true},
+			"/search/archive/": {Mode: QueryModeStrip},
+			"/api/":            {Mode: QueryModeKeep},
+		},
+	}
+
+	policies := cfg.Policies()
+
+	var prefixes []string
+	for _, p := range policies {
+		prefixes = append(prefixes, p.Prefix)
+	}
+	want := []string{"/search/archive/", "/search/", "/api/", ""}
+	if len(prefixes) != len(want) {
+		t.Fatalf("expected prefixes %v, got %v", want, prefixes)
+	}
+	for i := range want {
+		if prefixes[i] != want[i] {
+			t.Errorf("policy %d: expected prefix %q, got %q", i, want[i], prefixes[i])
+		}
+	}
+	if policies[2].Mode != QueryModeKeep {
+		t.Errorf("expected /api/ to keep query strings, got %q", policies[2].Mode)
+	}
+}
+
+func TestQueryConfigPolicies_PassthroughGlobalOmitted(t *testing.T) {
+	cfg := QueryConfig{
+		Prefixes: map[string]QueryPolicy{"/search/": {Mode: QueryModeStrip}},
+	}
+	policies := cfg.Policies()
+	if len(policies) != 1 || policies[0].Prefix != "/search/" {
+		t.Errorf("expected only the /search/ policy, got %v", policies)
+	}
+}
+
+func TestQueryConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     QueryConfig
+		wantErr bool
+	}{
+		{"empty", QueryConfig{}, false},
+		{"deny", QueryConfig{QueryPolicy: QueryPolicy{Mode: QueryModeDeny, Params: []string{"gclid"}}}, false},
+		{"sort only", QueryConfig{QueryPolicy: QueryPolicy{Sort: true}}, false},
+		{"unknown mode", QueryConfig{QueryPolicy: QueryPolicy{Mode: "drop"}}, true},
+		{"allow without params", QueryConfig{QueryPolicy: QueryPolicy{Mode: QueryModeAllow}}, true},
+		{"strip with params", QueryConfig{QueryPolicy: QueryPolicy{Mode: QueryModeStrip, Params: []string{"q"}}}, true},
+		{"bare wildcard", QueryConfig{QueryPolicy: QueryPolicy{Mode: QueryModeDeny, Params: []string{"*"}}}, true},
+		{"relative prefix", QueryConfig{Prefixes: map[string]QueryPolicy{"search/": {Mode: QueryModeStrip}}}, true},
+		{"bad prefix policy", QueryConfig{Prefixes: map[string]QueryPolicy{"/search/": {Mode: QueryModeAllow}}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestQueryPolicyString(t *testing.T) {
+	p := QueryPolicy{Mode: QueryModeDeny, Params: []string{"utm_*", "fbclid"}, Sort: true}
+	if got, want := p.String(), "deny utm_*, fbclid; sorted"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+	if got, want := (QueryPolicy{}).String(), "keep"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
@@ -1,27 +1,53 @@
 // This file is embedded into the hedgerules binary and deployed to CloudFront.
-// At deploy time, `var kvsId = '<arn>';` is prepended to this source.
+// At deploy time, `var kvsId = '<arn>';` and `var debugHeaders = true/false;`
+// are prepended to this source.
 // The CloudFront Functions runtime requires the KVS ID to be passed explicitly
 // to cf.kvs() — there is no way to auto-discover an associated KVS.
+// When a query string policy is configured, `var queryPolicies = [...];` is
+// prepended as well, ordered longest prefix first. When the KVS is shared
+// with the viewer-response function, `var kvsPrefix = "r:";` is prepended and
+// redirect keys carry that prefix.
 
 import cf from 'cloudfront';
+import crypto from 'crypto';
+
+// Longest KVS key. Keep in sync with kvs.MaxKeyBytes.
+var maxKeyBytes = 512;
 
 async function handler(event) {
   var request = event.request;
   var uri = request.uri;
+  var debug = typeof debugHeaders !== 'undefined' && debugHeaders;
+  var lookupError = '';
+  var prefix = typeof kvsPrefix !== 'undefined' ? kvsPrefix : '';
+
+  // Only this function sets x-hedgerules-request-* headers. Drop any the
+  // client sent, debug or not, so viewer-response never reflects them.
+  removeDebugHeaders(request.headers);
 
   // Single KVS lookup for redirect
   try {
     var kvs = cf.kvs(kvsId);
-    var dest = await kvs.get(uri);
+    var dest = await kvs.get(storeKey(prefix + uri));
     if (dest) {
-      return {
+      var response = {
         statusCode: 301,
         statusDescription: 'Moved Permanently',
         headers: { 'location': { value: dest } }
       };
+      // The viewer-response function doesn't run for responses generated
+      // here, so redirect debug headers go straight on the response.
+      if (debug) {
+        setDebugHeaders(response.headers, uri, 'redirect', dest, '', null);
+      }
+      return response;
     }
   } catch (err) {
-    // Key not found, continue to index rewrite
+    // Key not found, continue to index rewrite. Only other errors are worth
+    // a debug header.
+    if (!isNotFound(err)) {
+      lookupError = err && err.message ? err.message : String(err);
+    }
   }
 
   // Append index.html for directory requests
@@ -29,5 +55,117 @@ async function handler(event) {
     request.uri += 'index.html';
   }
 
+  var queryPolicy = null;
+  if (typeof queryPolicies !== 'undefined') {
+    queryPolicy = normalizeQuery(request, uri);
+  }
+
+  // Pass what we looked up to the viewer-response function as request
+  // headers; it copies x-hedgerules-request-* onto the response.
+  if (debug) {
+    setDebugHeaders(request.headers, uri, 'none', request.uri, lookupError, queryPolicy);
+  }
+
   return request;
 }
+
+// Reports whether a kvs.get error is the one it throws for a missing key.
+function isNotFound(err) {
+  return /not found/i.test(err && err.message ? err.message : String(err));
+}
+
+// Delete every x-hedgerules-request-* header from headers.
+function removeDebugHeaders(headers) {
+  var names = Object.keys(headers || {});
+  for (var i = 0; i < names.length; i++) {
+    if (names[i].startsWith('x-hedgerules-request-')) {
+      delete headers[names[i]];
+    }
+  }
+}
+
+function setDebugHeaders(headers, key, match, rewrite, error, queryPolicy) {
+  headers['x-hedgerules-request-key'] = { value: key.substring(0, 200) };
+  headers['x-hedgerules-request-match'] = { value: match };
+  headers['x-hedgerules-request-rewrite'] = { value: rewrite.substring(0, 200) };
+  if (error) {
+    headers['x-hedgerules-request-error'] = { value: error.substring(0, 200).replace(/[\r\n]+/g, ' ') };
+  }
+  if (queryPolicy) {
+    headers['x-hedgerules-request-query'] = { value: (queryPolicy.prefix || '(default)').substring(0, 200) };
+  }
+}
+
+// The KVS key for key: key itself, or, if it is longer than the KVS allows,
+// '$' and the first 32 hex digits of its SHA-256 hash. Keep in sync with
+// kvs.LongKey.
+function storeKey(key) {
+  if (utf8Bytes(key).length <= maxKeyBytes) {
+    return key;
+  }
+  return '$' + crypto.createHash('sha256').update(key).digest('hex').substring(0, 32);
+}
+
+// The UTF-8 encoding of s, as an array of bytes.
+function utf8Bytes(s) {
+  var bytes = [];
+  for (var i = 0; i < s.length; i++) {
+    var c = s.charCodeAt(i);
+    if (c < 0x80) {
+      bytes.push(c);
+    } else if (c < 0x800) {
+      bytes.push(0xc0 | c >> 6, 0x80 | c & 0x3f);
+    } else if (c >= 0xd800 && c < 0xdc00 && i + 1 < s.length) {
+      var cp = 0x10000 + ((c - 0xd800) << 10) + (s.charCodeAt(++i) - 0xdc00);
+      bytes.push(0xf0 | cp >> 18, 0x80 | cp >> 12 & 0x3f, 0x80 | cp >> 6 & 0x3f, 0x80 | cp & 0x3f);
+    } else {
+      bytes.push(0xe0 | c >> 12, 0x80 | c >> 6 & 0x3f, 0x80 | c & 0x3f);
+    }
+  }
+  return bytes;
+}
+
+// Apply the first query string policy whose prefix matches uri, so tracking
+// parameters and parameter order don't fragment the cache.
+// Returns the policy that was applied, or null.
+function normalizeQuery(request, uri) {
+  var policy = null;
+  for (var i = 0; i < queryPolicies.length; i++) {
+    if (uri.startsWith(queryPolicies[i].prefix)) {
+      policy = queryPolicies[i];
+      break;
+    }
+  }
+  if (!policy) {
+    return null;
+  }
+  if (policy.mode === 'strip') {
+    request.querystring = {};
+    return policy;
+  }
+
+  var names = Object.keys(request.querystring);
+  if (policy.sort) {
+    names.sort();
+  }
+  var qs = {};
+  for (var i = 0; i < names.length; i++) {
+    var listed = queryParamListed(names[i], policy.params || []);
+    if (policy.mode === 'allow' ? listed : !(policy.mode === 'deny' && listed)) {
+      qs[names[i]] = request.querystring[names[i]];
+    }
+  }
+  request.querystring = qs;
+  return policy;
+}
+
+// Params ending in '*' match by prefix, e.g. 'utm_*' matches 'utm_source'.
+function queryParamListed(name, params) {
+  for (var i = 0; i < params.length; i++) {
+    var p = params[i];
+    if (p.endsWith('*') ? name.startsWith(p.slice(0, -1)) : name === p) {
+      return true;
+    }
+  }
+  return false;
+}
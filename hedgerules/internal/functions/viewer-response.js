@@ -1,13 +1,23 @@
 // This file is embedded into the hedgerules binary and deployed to CloudFront.
 // At deploy time, `var kvsId = '<arn>';` and `var debugHeaders = true/false;`
-// are prepended to this source.
+// are prepended to this source. In compiled mode (see headers.Compile),
+// `var compiledHeaders = true;` is prepended as well. When the KVS is shared
+// with the viewer-request function, `var kvsPrefix = "h:";` is prepended and
+// header keys, including those of shared header sets, carry that prefix.
+// When header keys include directory-scoped extensions like /docs/*.pdf,
+// `var scopedGlobs = true;` is prepended.
 
 import cf from 'cloudfront';
+import crypto from 'crypto';
 
 // Max response headers is 8KB total.
 // Reserve 2-3KB for CloudFront/S3 headers, ~1KB for debug headers.
+// Deploy checks header sets against this limit too (headers.Budget).
 var headerSizeLimitBytes = 4096;
 
+// Longest KVS key. Keep in sync with kvs.MaxKeyBytes.
+var maxKeyBytes = 512;
+
 async function handler(event) {
   var response = event.response;
   response.headers = response.headers || {};
@@ -19,81 +29,101 @@ async function handler(event) {
   }
 
   try {
-    // Build list of patterns to check in order of specificity (least to most).
-    // Later matches override earlier ones.
-    var patterns = [];
-
-    // 1. Root path (always check, lowest priority)
-    patterns.push('/');
+    var compiled = typeof compiledHeaders !== 'undefined' && compiledHeaders;
 
-    // 2. Each parent directory with trailing /
-    var parts = path.split('/').filter(function(p) { return p; });
-    for (var i = 0; i < parts.length - 1; i++) {
-      patterns.push('/' + parts.slice(0, i + 1).join('/') + '/');
-    }
+    // In compiled mode, deploy has already resolved the cascade into a
+    // single header set per path. Otherwise, check every pattern in order of
+    // specificity (least to most); later matches override earlier ones.
+    var patterns = compiled ? [path] : cascadePatterns(path);
 
-    // 3. Extension wildcard (e.g., *.xml, *.html)
-    var lastSegment = parts[parts.length - 1] || '';
-    var lastDotIndex = lastSegment.lastIndexOf('.');
-    if (lastDotIndex !== -1 && lastDotIndex < lastSegment.length - 1) {
-      patterns.push('*.' + lastSegment.substring(lastDotIndex + 1));
-    }
+    // Request tokens available in header values, e.g. {/path}
+    var tokens = requestTokens(request, response, path);
 
-    // 4. Exact path (most specific)
-    if (path !== '/') {
-      patterns.push(path);
-    }
-
-    // Collect headers from all matching patterns
+    // Collect headers from all matching patterns. A null value means the
+    // header is removed from the response.
     var headers = {};
     var matched = [];
     var totalAddedBytes = 0;
     var truncated = false;
 
     for (var i = 0; i < patterns.length; i++) {
-      try {
-        var value = await kvs.get(patterns[i]);
-        if (value) {
-          matched.push(i);
-          var lines = value.split('\n');
-          for (var j = 0; j < lines.length; j++) {
-            var line = lines[j].trim();
-            var idx = line.indexOf(':');
-            if (idx !== -1) {
-              var name = line.substring(0, idx).trim().toLowerCase();
-              var val = line.substring(idx + 1).trim();
-              // For {/path}, use the user-facing path: undo the viewer-request
-              // rewrite that turns /test/ into /test/index.html for S3.
-              var userPath = path.endsWith('/index.html') ? path.slice(0, -'index.html'.length) : path;
-              val = val.replace('{/path}', userPath);
+      var value = await lookup(kvs, patterns[i]);
+      if (!value && compiled && patterns[i] !== '/') {
+        // Paths outside the build output get the root header set
+        patterns.push('/');
+        continue;
+      }
+      if (value) {
+        matched.push(i);
+        var lines = value.split('\n');
+        // Versioned values (see headers.Encode) start with '~1' and escape
+        // backslash, CR and LF in values. Anything else is a legacy list of
+        // "Name: value" lines.
+        var versioned = lines[0] === '~1';
+        for (var j = versioned ? 1 : 0; j < lines.length; j++) {
+          var line = versioned ? lines[j] : lines[j].trim();
+          var idx = line.indexOf(':');
+          if (idx !== -1) {
+            var name = line.substring(0, idx).trim().toLowerCase();
+            var val = line.substring(idx + 1);
+            val = versioned ? unescapeValue(val) : val.trim();
+            // Operators: '+name' appends, '!name' removes (versioned only)
+            var op = versioned ? name.charAt(0) : '';
+            if (op === '+' || op === '!') {
+              name = name.substring(1);
+            }
+            if (op === '!') {
               if (name) {
-                var headerSize = name.length + val.length + 4;
-                if (totalAddedBytes + headerSize > headerSizeLimitBytes) {
-                  truncated = true;
-                  break;
+                headers[name] = null;
+              }
+              continue;
+            }
+            val = expandTokens(val, tokens);
+            if (name) {
+              var headerSize = name.length + val.length + 4;
+              if (totalAddedBytes + headerSize > headerSizeLimitBytes) {
+                truncated = true;
+                break;
+              }
+              if (op === '+') {
+                // Append to the value from a less specific pattern, or else
+                // the origin's value, unless an earlier pattern removed it.
+                var base = name in headers ? headers[name]
+                  : response.headers[name] ? response.headers[name].value : null;
+                if (base) {
+                  val = base + ', ' + val;
                 }
-                headers[name] = val;
-                totalAddedBytes += headerSize;
               }
+              headers[name] = val;
+              totalAddedBytes += headerSize;
             }
           }
-          if (truncated) {
-            break;
-          }
         }
-      } catch (err) {
-        // Key not found in KVS, continue
+        if (truncated) {
+          break;
+        }
       }
     }
 
     // Apply collected headers to response
     var names = Object.keys(headers);
     for (var i = 0; i < names.length; i++) {
-      response.headers[names[i]] = { value: headers[names[i]] };
+      if (headers[names[i]] === null) {
+        delete response.headers[names[i]];
+      } else {
+        response.headers[names[i]] = { value: headers[names[i]] };
+      }
     }
 
     // Debug headers (conditional on injected debugHeaders variable)
     if (typeof debugHeaders !== 'undefined' && debugHeaders) {
+      // Surface what viewer-request looked up, passed along as request headers
+      var requestHeaders = Object.keys(request.headers || {});
+      for (var i = 0; i < requestHeaders.length; i++) {
+        if (requestHeaders[i].startsWith('x-hedgerules-request-')) {
+          response.headers[requestHeaders[i]] = { value: request.headers[requestHeaders[i]].value };
+        }
+      }
       response.headers['x-hedgerules-patterns'] = { value: patterns.join(',').substring(0, 200) };
       response.headers['x-hedgerules-matched'] = { value: matched.join(',').substring(0, 200) };
       response.headers['x-hedgerules-size'] = { value: String(totalAddedBytes) };
@@ -115,3 +145,132 @@ async function handler(event) {
 
   return response;
 }
+
+// Build list of patterns to check in order of specificity (least to most).
+// Keep in sync with headers.Patterns.
+function cascadePatterns(path) {
+  var patterns = [];
+
+  // 1. Root path (always check, lowest priority)
+  patterns.push('/');
+
+  // 2. Each parent directory with trailing /
+  var parts = path.split('/').filter(function(p) { return p; });
+  for (var i = 0; i < parts.length - 1; i++) {
+    patterns.push('/' + parts.slice(0, i + 1).join('/') + '/');
+  }
+
+  // 3. Extension wildcard (e.g., *.xml, *.html)
+  // 4. Directory-scoped extension (e.g., /docs/*.pdf). Deploy expands
+  //    globs like /docs/**/*.pdf into one of these per directory, and only
+  //    sets scopedGlobs when there are any, to save the lookup otherwise.
+  var lastSegment = parts[parts.length - 1] || '';
+  var lastDotIndex = lastSegment.lastIndexOf('.');
+  if (lastDotIndex !== -1 && lastDotIndex < lastSegment.length - 1) {
+    var ext = lastSegment.substring(lastDotIndex + 1);
+    var dir = '/' + parts.slice(0, parts.length - 1).join('/');
+    patterns.push('*.' + ext);
+    if (typeof scopedGlobs !== 'undefined' && scopedGlobs) {
+      patterns.push((dir === '/' ? '/' : dir + '/') + '*.' + ext);
+    }
+  }
+
+  // 5. Exact path (most specific)
+  if (path !== '/') {
+    patterns.push(path);
+  }
+  return patterns;
+}
+
+// Get the header set for a key, following a reference ('@' and the key of a
+// shared header set, see headers.Ref). Returns null for a missing key.
+async function lookup(kvs, key) {
+  var prefix = typeof kvsPrefix !== 'undefined' ? kvsPrefix : '';
+  var value;
+  try {
+    value = await kvs.get(storeKey(prefix + key));
+  } catch (err) {
+    return null;
+  }
+  if (value && value.charAt(0) === '@') {
+    try {
+      value = await kvs.get(storeKey(prefix + value.substring(1)));
+    } catch (err) {
+      throw new Error('dangling header set reference ' + value + ' at ' + key);
+    }
+  }
+  return value || null;
+}
+
+// The KVS key for key: key itself, or, if it is longer than the KVS allows,
+// '$' and the first 32 hex digits of its SHA-256 hash. Keep in sync with
+// kvs.LongKey.
+function storeKey(key) {
+  if (utf8Bytes(key).length <= maxKeyBytes) {
+    return key;
+  }
+  return '$' + crypto.createHash('sha256').update(key).digest('hex').substring(0, 32);
+}
+
+// The UTF-8 encoding of s, as an array of bytes.
+function utf8Bytes(s) {
+  var bytes = [];
+  for (var i = 0; i < s.length; i++) {
+    var c = s.charCodeAt(i);
+    if (c < 0x80) {
+      bytes.push(c);
+    } else if (c < 0x800) {
+      bytes.push(0xc0 | c >> 6, 0x80 | c & 0x3f);
+    } else if (c >= 0xd800 && c < 0xdc00 && i + 1 < s.length) {
+      var cp = 0x10000 + ((c - 0xd800) << 10) + (s.charCodeAt(++i) - 0xdc00);
+      bytes.push(0xf0 | cp >> 18, 0x80 | cp >> 12 & 0x3f, 0x80 | cp >> 6 & 0x3f, 0x80 | cp & 0x3f);
+    } else {
+      bytes.push(0xe0 | c >> 12, 0x80 | c >> 6 & 0x3f, 0x80 | c & 0x3f);
+    }
+  }
+  return bytes;
+}
+
+// Values for request tokens. Keep in sync with headers.TokenMaxBytes.
+function requestTokens(request, response, path) {
+  // For {/path}, use the user-facing path: undo the viewer-request rewrite
+  // that turns /test/ into /test/index.html for S3.
+  var userPath = path.endsWith('/index.html') ? path.slice(0, -'index.html'.length) : path;
+  var slash = path.lastIndexOf('/');
+  var headers = request.headers || {};
+  var query = [];
+  var qs = request.querystring || {};
+  var keys = Object.keys(qs);
+  for (var i = 0; i < keys.length; i++) {
+    var values = qs[keys[i]].multiValue || [qs[keys[i]]];
+    for (var j = 0; j < values.length; j++) {
+      query.push(values[j].value === '' ? keys[i] : keys[i] + '=' + values[j].value);
+    }
+  }
+  return {
+    '/path': userPath,
+    '/dir': path.substring(0, slash + 1),
+    'basename': path.substring(slash + 1),
+    'host': headers.host ? headers.host.value : '',
+    'query': query.join('&'),
+    'country': headers['cloudfront-viewer-country'] ? headers['cloudfront-viewer-country'].value : '',
+    'status': String(response.statusCode)
+  };
+}
+
+// Replace every {token} with its value, and {{ with a literal {.
+// Unknown tokens are left as is; deploy rejects them.
+function expandTokens(val, tokens) {
+  return val.replace(/\{\{|\{(\/?[a-z]+)\}/g, function(m, name) {
+    if (m === '{{') {
+      return '{';
+    }
+    return name in tokens ? tokens[name] : m;
+  });
+}
+
+function unescapeValue(val) {
+  return val.replace(/\\(.)/g, function(m, c) {
+    return c === 'n' ? '\n' : c === 'r' ? '\r' : c;
+  });
+}
@@ -0,0 +1,212 @@
+package headers
+
+import (
+	"fmt"
+	"maps"
+	"strings"
+)
+
+// MaxLookups is the most KVS lookups deploy expects viewer-response.js to
+// need for a single request. CloudFront documents no limit on lookups, but
+// each one eats into the function's compute budget, so deploy warns about
+// paths that would need more.
+const MaxLookups = 10
+
+// Patterns returns the KVS keys viewer-response.js looks up for a request
+// path, from least to most specific. It must match the function:
+//
+//  1. the root "/"
+//  2. each parent directory, with a trailing "/"
+//  3. the extension wildcard, e.g. "*.pdf"
+//  4. the directory-scoped extension, e.g. "/docs/*.pdf", which the function
+//     only looks up when the KVS has such keys (see HasScopedGlobs)
+//  5. the exact path
+func Patterns(path string) []string {
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	patterns := []string{"/"}
+
+	var parts []string
+	for _, p := range strings.Split(path, "/") {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	for i := 0; i < len(parts)-1; i++ {
+		patterns = append(patterns, "/"+strings.Join(parts[:i+1], "/")+"/")
+	}
+
+	last := ""
+	if len(parts) > 0 {
+		last = parts[len(parts)-1]
+	}
+	if dot := strings.LastIndex(last, "."); dot != -1 && dot < len(last)-1 {
+		ext := last[dot+1:]
+		dir := "/"
+		if len(parts) > 1 {
+			dir = "/" + strings.Join(parts[:len(parts)-1], "/") + "/"
+		}
+		patterns = append(patterns, "*."+ext, dir+"*."+ext)
+	}
+
+	if path != "/" {
+		patterns = append(patterns, path)
+	}
+	return patterns
+}
+
+// Result is what viewer-response.js would do to one response.
+type Result struct {
+	// Headers maps each lowercased header name to its value, or to nil if
+	// the header is removed.
+	Headers map[string]*string
+	// Matched lists the patterns that had a KVS entry, least specific first.
+	Matched []string
+	// Size is the bytes of headers added, counted as the function does.
+	Size int
+	// Truncated is set when the next header would have gone over Budget, so
+	// it and every header after it were dropped.
+	Truncated bool
+	// AlwaysTruncated is set when the headers go over Budget even with the
+	// request tokens expanded to nothing, so every request is truncated, not
+	// just ones with long token values.
+	AlwaysTruncated bool
+}
+
+// Beneath returns the patterns less specific than key that match every path
+// key matches, from least to most specific: for /docs/*.pdf, these are "/",
+// "/docs/" and "*.pdf". A header one of them sets for those paths is
+// overridden by key's.
+func Beneath(key string) []string {
+	var beneath []string
+	for _, p := range Patterns(key) {
+		if p == key {
+			break
+		}
+		beneath = append(beneath, p)
+	}
+	return beneath
+}
+
+// Resolve runs the header cascade for a request path against the header KVS
+// entries in store, as viewer-response.js does. Path tokens take their values
+// from path; tokens that depend on the request, like {host}, take their
+// longest value from TokenMaxBytes, so Size is the worst case. If that
+// truncates the headers, Resolve runs the cascade again with those tokens
+// empty to set AlwaysTruncated. Appends build on headers from the cascade
+// only, since the origin's are unknown here.
+func Resolve(path string, store map[string]string) (Result, error) {
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	longest := make(map[string]string, len(TokenMaxBytes))
+	empty := make(map[string]string, len(TokenMaxBytes))
+	for name, n := range TokenMaxBytes {
+		longest[name] = strings.Repeat("x", n)
+		empty[name] = ""
+	}
+	r, err := resolve(path, store, longest)
+	if err != nil || !r.Truncated {
+		return r, err
+	}
+	least, err := resolve(path, store, empty)
+	r.AlwaysTruncated = least.Truncated
+	return r, err
+}
+
+// resolve runs the header cascade for path with request tokens taking their
+// values from vars.
+func resolve(path string, store map[string]string, vars map[string]string) (Result, error) {
+	vars = maps.Clone(vars)
+	slash := strings.LastIndex(path, "/")
+	vars["/path"] = path
+	if strings.HasSuffix(path, "/index.html") {
+		vars["/path"] = strings.TrimSuffix(path, "index.html")
+	}
+	vars["/dir"] = path[:slash+1]
+	vars["basename"] = path[slash+1:]
+
+	r := Result{Headers: make(map[string]*string)}
+	for _, pattern := range Patterns(path) {
+		value, err := lookup(store, pattern)
+		if err != nil {
+			return r, err
+		}
+		if value == "" {
+			continue
+		}
+		fields, err := Decode(value)
+		if err != nil {
+			return r, fmt.Errorf("%s: %w", pattern, err)
+		}
+		r.Matched = append(r.Matched, pattern)
+		for _, f := range fields {
+			if f.Op == OpRemove {
+				r.Headers[f.Name] = nil
+				continue
+			}
+			val := ExpandTokens(f.Value, vars)
+			size := len(f.Name) + len(val) + 4
+			if r.Size+size > Budget {
+				r.Truncated = true
+				return r, nil
+			}
+			if base := r.Headers[f.Name]; f.Op == OpAppend && base != nil && *base != "" {
+				val = *base + ", " + val
+			}
+			r.Headers[f.Name] = &val
+			r.Size += size
+		}
+	}
+	return r, nil
+}
+
+// Lookups returns how many KVS lookups viewer-response.js makes in cascade
+// mode for a request path: one per pattern, plus one for each reference it
+// follows. scopedGlobs is whether the function looks up directory-scoped
+// extension keys (see HasScopedGlobs).
+func Lookups(path string, store map[string]string, scopedGlobs bool) int {
+	n := 0
+	for _, pattern := range Patterns(path) {
+		if !scopedGlobs && IsScopedGlob(pattern) {
+			continue
+		}
+		n++
+		if IsRef(store[pattern]) {
+			n++
+		}
+	}
+	return n
+}
+
+// lookup returns the header set stored under key, following a reference as
+// viewer-response.js does, or "" if there is none.
+func lookup(store map[string]string, key string) (string, error) {
+	value := store[key]
+	if !IsRef(value) {
+		return value, nil
+	}
+	set, ok := store[value[len(RefPrefix):]]
+	if !ok {
+		return "", fmt.Errorf("%s: dangling header set reference %s", key, value)
+	}
+	return set, nil
+}
+
+// IsScopedGlob reports whether key is a directory-scoped extension key, like
+// "/docs/*.pdf".
+func IsScopedGlob(key string) bool {
+	return strings.HasPrefix(key, "/") && strings.HasPrefix(key[strings.LastIndex(key, "/")+1:], "*.")
+}
+
+// HasScopedGlobs reports whether any key in store is a directory-scoped
+// extension key. Only then does viewer-response.js spend a lookup on them.
+func HasScopedGlobs(store map[string]string) bool {
+	for key := range store {
+		if IsScopedGlob(key) {
+			return true
+		}
+	}
+	return false
+}
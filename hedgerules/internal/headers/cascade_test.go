@@ -0,0 +1,104 @@
+package headers
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPatterns(t *testing.T) {
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{"/", []string{"/"}},
+		{"/index.html", []string{"/", "*.html", "/*.html", "/index.html"}},
+		{"/docs/guide/manual.pdf", []string{"/", "/docs/", "/docs/guide/", "*.pdf", "/docs/guide/*.pdf", "/docs/guide/manual.pdf"}},
+		{"/docs/readme", []string{"/", "/docs/", "/docs/readme"}},
+		{"docs/a.css", []string{"/", "/docs/", "*.css", "/docs/*.css", "/docs/a.css"}},
+	}
+	for _, tt := range tests {
+		if got := Patterns(tt.path); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Patterns(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestBeneath(t *testing.T) {
+	tests := map[string][]string{
+		"/":                 nil,
+		"/docs/api/":        {"/", "/docs/"},
+		"*.pdf":             {"/"},
+		"/*.pdf":            {"/", "*.pdf"},
+		"/docs/*.pdf":       {"/", "/docs/", "*.pdf"},
+		"/docs/a.3f2a9c.js": {"/", "/docs/", "*.js", "/docs/*.js"},
+	}
+	for key, want := range tests {
+		if got := Beneath(key); !reflect.DeepEqual(got, want) {
+			t.Errorf("Beneath(%q) = %v, want %v", key, got, want)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	store := map[string]string{
+		"/":                Encode(map[string]string{"Vary": "Accept-Encoding", "!Server": "", "X-Frame-Options": "DENY"}),
+		"/docs/":           Encode(map[string]string{"+Vary": "Origin", "X-Frame-Options": "SAMEORIGIN"}),
+		"*.pdf":            Encode(map[string]string{"X-Robots-Tag": "noindex"}),
+		"/docs/index.html": Encode(map[string]string{"Link": "<https://example.com{/path}>; rel=canonical"}),
+	}
+
+	r, err := Resolve("/docs/index.html", store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	str := func(s string) *string { return &s }
+	want := map[string]*string{
+		"server":          nil,
+		"vary":            str("Accept-Encoding, Origin"),
+		"x-frame-options": str("SAMEORIGIN"),
+		"link":            str("<https://example.com/docs/>; rel=canonical"),
+	}
+	if !reflect.DeepEqual(r.Headers, want) {
+		t.Errorf("expected %v, got %v", want, r.Headers)
+	}
+	if wantMatched := []string{"/", "/docs/", "/docs/index.html"}; !reflect.DeepEqual(r.Matched, wantMatched) {
+		t.Errorf("expected matched %v, got %v", wantMatched, r.Matched)
+	}
+	if r.Truncated {
+		t.Error("unexpected truncation")
+	}
+}
+
+func TestResolve_Truncated(t *testing.T) {
+	store := map[string]string{
+		"/":      Encode(map[string]string{"X-A": strings.Repeat("a", 3000)}),
+		"/docs/": Encode(map[string]string{"X-B": "{query}{query}"}),
+	}
+	r, err := Resolve("/docs/page.html", store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// {query} is counted at its longest, pushing x-b over the budget
+	if !r.Truncated {
+		t.Error("expected truncation")
+	}
+	// With a short query string it fits
+	if r.AlwaysTruncated {
+		t.Error("expected truncation only for long tokens")
+	}
+	if _, ok := r.Headers["x-b"]; ok {
+		t.Error("expected x-b to be dropped")
+	}
+	if r.Size != 3+3000+4 {
+		t.Errorf("expected size %d, got %d", 3+3000+4, r.Size)
+	}
+
+	store["/docs/"] = Encode(map[string]string{"X-B": strings.Repeat("b", 1100) + "{query}"})
+	if r, err = Resolve("/docs/page.html", store); err != nil {
+		t.Fatal(err)
+	}
+	if !r.AlwaysTruncated {
+		t.Error("expected truncation without tokens")
+	}
+}
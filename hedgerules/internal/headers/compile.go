@@ -0,0 +1,108 @@
+package headers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// RefPrefix starts a KVS value that refers to a header set stored under
+// another key, e.g. "@#3f2a9c1d0b1e4f5a". viewer-response.js follows one
+// level of reference.
+const RefPrefix = "@"
+
+// SetKey returns the content-addressed KVS key for an encoded header set.
+// Keys start with "#", which no path or extension pattern does.
+func SetKey(encoded string) string {
+	sum := sha256.Sum256([]byte(encoded))
+	return "#" + hex.EncodeToString(sum[:8])
+}
+
+// Ref returns the KVS value that refers to the header set stored under key.
+func Ref(key string) string {
+	return RefPrefix + key
+}
+
+// IsRef reports whether a KVS value is a reference made by Ref.
+func IsRef(value string) bool {
+	return strings.HasPrefix(value, RefPrefix)
+}
+
+// Effective folds every entry in store that the cascade matches for path into
+// the single encoded header set that has the same effect, and reports whether
+// any entry matched. Tokens are kept for viewer-response.js to expand.
+func Effective(path string, store map[string]string) (string, bool, error) {
+	var rules map[string]string
+	matched := false
+	for _, pattern := range Patterns(path) {
+		value, err := lookup(store, pattern)
+		if err != nil {
+			return "", false, err
+		}
+		if value == "" {
+			continue
+		}
+		fields, err := Decode(value)
+		if err != nil {
+			return "", false, fmt.Errorf("%s: %w", pattern, err)
+		}
+		rules = Merge(rules, Rules(fields))
+		matched = true
+	}
+	if !matched {
+		return "", false, nil
+	}
+	return Encode(rules), true, nil
+}
+
+// Compile resolves the cascade in store for "/" and every file, and returns
+// the KVS contents for compiled mode: each distinct effective header set once,
+// under its SetKey, and each path with a Ref to its set. viewer-response.js
+// then needs two lookups per request instead of one per pattern. Requests for
+// paths that are not in files fall back to the set for "/".
+func Compile(files []string, store map[string]string) (map[string]string, error) {
+	compiled := make(map[string]string)
+	for _, path := range append([]string{"/"}, files...) {
+		set, ok, err := Effective(path, store)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		key := SetKey(set)
+		compiled[key] = set
+		compiled[path] = Ref(key)
+	}
+	return compiled, nil
+}
+
+// Share returns store with every header set that appears under more than one
+// key stored once, under its SetKey, and each of those keys holding a Ref to
+// it instead. Sets too small for a reference to save space are left inline.
+// Following a reference costs viewer-response.js an extra lookup.
+func Share(store map[string]string) map[string]string {
+	keysByValue := make(map[string][]string)
+	for key, value := range store {
+		keysByValue[value] = append(keysByValue[value], key)
+	}
+
+	shared := make(map[string]string, len(store))
+	for value, keys := range keysByValue {
+		setKey := SetKey(value)
+		ref := Ref(setKey)
+		inline := len(keys) * len(value)
+		if len(keys) < 2 || IsRef(value) || len(setKey)+len(value)+len(keys)*len(ref) >= inline {
+			for _, key := range keys {
+				shared[key] = value
+			}
+			continue
+		}
+		shared[setKey] = value
+		for _, key := range keys {
+			shared[key] = ref
+		}
+	}
+	return shared
+}
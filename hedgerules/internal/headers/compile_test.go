@@ -0,0 +1,118 @@
+package headers
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEffective(t *testing.T) {
+	store := map[string]string{
+		"/":           Encode(map[string]string{"Vary": "Accept-Encoding", "!Server": "", "X-Frame-Options": "DENY"}),
+		"/docs/":      Encode(map[string]string{"+Vary": "Origin", "X-Frame-Options": "SAMEORIGIN", "+Link": "</a.css>"}),
+		"*.html":      Encode(map[string]string{"+Link": "</b.css>"}),
+		"/docs/a.pdf": Encode(map[string]string{"Server": "hedgerules"}),
+	}
+
+	got, ok, err := Effective("/docs/index.html", store)
+	if err != nil || !ok {
+		t.Fatalf("expected a match, got %v, %v", ok, err)
+	}
+	want := "~1\n+link:</a.css>, </b.css>\n!server:\nvary:Accept-Encoding\n+vary:Origin\nx-frame-options:SAMEORIGIN"
+	if got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+
+	got, _, _ = Effective("/docs/a.pdf", store)
+	if !strings.Contains(got, "\nserver:hedgerules") || strings.Contains(got, "!server") {
+		t.Errorf("expected the exact path to set server again, got %q", got)
+	}
+
+	if _, ok, _ := Effective("/x", map[string]string{}); ok {
+		t.Error("expected no match for an empty store")
+	}
+}
+
+func TestCompile(t *testing.T) {
+	store := map[string]string{
+		"/":        Encode(map[string]string{"X-Frame-Options": "DENY"}),
+		"/blog/":   Encode(map[string]string{"X-Section": "blog"}),
+		"/a.html":  Encode(map[string]string{"X-A": "{/path}"}),
+		"/unused/": Encode(map[string]string{"X-Unused": "1"}),
+	}
+	files := []string{"/index.html", "/a.html", "/blog/index.html", "/blog/post/index.html"}
+
+	compiled, err := Compile(files, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := Encode(map[string]string{"X-Frame-Options": "DENY"})
+	blog := Encode(map[string]string{"X-Frame-Options": "DENY", "X-Section": "blog"})
+	a := Encode(map[string]string{"X-Frame-Options": "DENY", "X-A": "{/path}"})
+	want := map[string]string{
+		"/":                     Ref(SetKey(root)),
+		"/index.html":           Ref(SetKey(root)),
+		"/a.html":               Ref(SetKey(a)),
+		"/blog/index.html":      Ref(SetKey(blog)),
+		"/blog/post/index.html": Ref(SetKey(blog)),
+		SetKey(root):            root,
+		SetKey(blog):            blog,
+		SetKey(a):               a,
+	}
+	if len(compiled) != len(want) {
+		t.Errorf("expected %d entries, got %d: %v", len(want), len(compiled), compiled)
+	}
+	for key, value := range want {
+		if compiled[key] != value {
+			t.Errorf("%s: expected %q, got %q", key, value, compiled[key])
+		}
+	}
+}
+
+func TestSetKey(t *testing.T) {
+	key := SetKey("~1\na:b")
+	if !strings.HasPrefix(key, "#") || len(key) != 17 {
+		t.Errorf("expected # and 16 hex digits, got %q", key)
+	}
+	if SetKey("~1\na:b") != key || SetKey("~1\na:c") == key {
+		t.Error("expected keys to depend only on content")
+	}
+	if !IsRef(Ref(key)) || IsRef("~1\na:b") {
+		t.Error("IsRef does not match Ref")
+	}
+}
+
+func TestShare(t *testing.T) {
+	long := Encode(map[string]string{"Cache-Control": "public, max-age=31536000, immutable"})
+	short := Encode(map[string]string{"A": "b"})
+	store := map[string]string{"/a/": long, "/b/": long, "/e/": long, "/c/": short, "/d/": short, "/": Encode(nil)}
+
+	shared := Share(store)
+	key := SetKey(long)
+	want := map[string]string{"/a/": Ref(key), "/b/": Ref(key), "/e/": Ref(key), key: long, "/c/": short, "/d/": short, "/": "~1"}
+	if !reflect.DeepEqual(shared, want) {
+		t.Errorf("expected %v, got %v", want, shared)
+	}
+
+	// Resolving through references gives the same headers
+	for _, path := range []string{"/a/x.html", "/c/x.html"} {
+		before, err := Resolve(path, store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		after, err := Resolve(path, shared)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(before.Headers, after.Headers) {
+			t.Errorf("%s: expected %v, got %v", path, before.Headers, after.Headers)
+		}
+	}
+}
+
+func TestResolve_DanglingRef(t *testing.T) {
+	if _, err := Resolve("/a.html", map[string]string{"/": Ref("#missing")}); err == nil {
+		t.Error("expected error for a dangling reference")
+	}
+}
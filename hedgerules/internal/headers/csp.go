@@ -0,0 +1,81 @@
+package headers
+
+import (
+	"fmt"
+	"strings"
+)
+
+// AddCSPSources returns csp with sources added to directive, for example
+// hashes of inline scripts to "script-src". A directive the policy leaves to
+// default-src starts as a copy of default-src, so it allows what it did
+// before. If neither is set the directive is unrestricted and csp is returned
+// unchanged, as it is when there are no sources to add. Sources already in
+// the directive are not repeated.
+//
+// Browsers ignore 'unsafe-inline' in a directive that lists a hash, so adding
+// hashes to one that allows it would block every inline event handler and
+// style attribute it allowed. Such a directive is left alone, and the error
+// says why.
+func AddCSPSources(csp, directive string, sources []string) (string, error) {
+	if len(sources) == 0 {
+		return csp, nil
+	}
+
+	var parts [][]string
+	target, fallback := -1, -1
+	for _, d := range strings.Split(csp, ";") {
+		fields := strings.Fields(d)
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToLower(fields[0]) {
+		case directive:
+			target = len(parts)
+		case "default-src":
+			fallback = len(parts)
+		}
+		parts = append(parts, fields)
+	}
+	if target == -1 {
+		if fallback == -1 {
+			return csp, nil
+		}
+		copied := append([]string{directive}, parts[fallback][1:]...)
+		target = len(parts)
+		parts = append(parts, copied)
+	}
+	for _, s := range parts[target][1:] {
+		if strings.EqualFold(s, "'unsafe-inline'") {
+			return csp, fmt.Errorf("%s allows 'unsafe-inline', which browsers ignore once it lists hashes, so its %d inline hashes were not added", directive, len(sources))
+		}
+	}
+
+	// 'none' cannot be combined with other sources
+	var kept []string
+	for _, s := range parts[target] {
+		if s != "'none'" {
+			kept = append(kept, s)
+		}
+	}
+	parts[target] = kept
+	for _, s := range sources {
+		if !containsString(parts[target][1:], s) {
+			parts[target] = append(parts[target], s)
+		}
+	}
+
+	directives := make([]string, len(parts))
+	for i, fields := range parts {
+		directives[i] = strings.Join(fields, " ")
+	}
+	return strings.Join(directives, "; "), nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,42 @@
+package headers
+
+import "testing"
+
+func TestAddCSPSources(t *testing.T) {
+	tests := []struct {
+		csp, directive string
+		sources        []string
+		want           string
+	}{
+		{"default-src 'self'; script-src 'self'", "script-src", []string{"'sha256-a'"}, "default-src 'self'; script-src 'self' 'sha256-a'"},
+		{"default-src 'self'", "script-src", []string{"'sha256-a'"}, "default-src 'self'; script-src 'self' 'sha256-a'"},
+		{"img-src *", "script-src", []string{"'sha256-a'"}, "img-src *"},
+		{"style-src 'none';frame-ancestors 'none'", "style-src", []string{"'sha256-b'"}, "style-src 'sha256-b'; frame-ancestors 'none'"},
+		{"script-src 'sha256-a'", "script-src", []string{"'sha256-a'", "'sha256-c'"}, "script-src 'sha256-a' 'sha256-c'"},
+		{"script-src 'self'", "script-src", nil, "script-src 'self'"},
+	}
+	for _, tt := range tests {
+		got, err := AddCSPSources(tt.csp, tt.directive, tt.sources)
+		if err != nil || got != tt.want {
+			t.Errorf("AddCSPSources(%q, %q, %v) = %q, %v, want %q", tt.csp, tt.directive, tt.sources, got, err, tt.want)
+		}
+	}
+}
+
+func TestAddCSPSources_UnsafeInline(t *testing.T) {
+	for _, csp := range []string{
+		"script-src 'self' 'unsafe-inline'",
+		"default-src 'self' 'UNSAFE-INLINE'",
+	} {
+		got, err := AddCSPSources(csp, "script-src", []string{"'sha256-a'"})
+		if err == nil || got != csp {
+			t.Errorf("AddCSPSources(%q) = %q, %v, want the policy unchanged and an error", csp, got, err)
+		}
+	}
+
+	// Only the directive that gets hashes matters
+	csp := "script-src 'self'; style-src 'self' 'unsafe-inline'"
+	if got, err := AddCSPSources(csp, "script-src", []string{"'sha256-a'"}); err != nil || got != "script-src 'self' 'sha256-a'; style-src 'self' 'unsafe-inline'" {
+		t.Errorf("expected script-src hashed, got %q, %v", got, err)
+	}
+}
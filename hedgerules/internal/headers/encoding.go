@@ -0,0 +1,206 @@
+// Package headers defines the header rules stored in the headers KVS and how
+// they are encoded into KVS values for viewer-response.js.
+package headers
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Version is the current header value encoding version.
+const Version = 1
+
+// versionLine starts every encoded value, so viewer-response.js can tell
+// versioned values from legacy "Name: value" lines.
+var versionLine = fmt.Sprintf("~%d", Version)
+
+// Op is what a header field does to the response.
+type Op byte
+
+const (
+	// OpSet sets the header, replacing any earlier value. Written "Name".
+	OpSet Op = iota
+	// OpAppend appends to the header's current value, from a less specific
+	// rule or the origin, separated by ", ". Written "+Name".
+	OpAppend
+	// OpRemove removes the header, including one sent by the origin. Written "!Name".
+	OpRemove
+)
+
+// Prefix returns the operator prefix written before a header name.
+func (o Op) Prefix() string {
+	switch o {
+	case OpAppend:
+		return "+"
+	case OpRemove:
+		return "!"
+	}
+	return ""
+}
+
+// rank orders fields for the same name: remove, then set, then append.
+func (o Op) rank() int {
+	switch o {
+	case OpRemove:
+		return 0
+	case OpSet:
+		return 1
+	}
+	return 2
+}
+
+// ParseName splits an operator prefix from a header name as written in
+// _hedge_headers.json, e.g. "+Link" is OpAppend on "Link".
+func ParseName(s string) (Op, string) {
+	s = strings.TrimSpace(s)
+	switch {
+	case strings.HasPrefix(s, "+"):
+		return OpAppend, s[1:]
+	case strings.HasPrefix(s, "!"):
+		return OpRemove, s[1:]
+	}
+	return OpSet, s
+}
+
+// Field is a single header operation in a header set.
+type Field struct {
+	Op    Op
+	Name  string
+	Value string
+}
+
+// Encode returns the canonical encoding of a header set: a version line, then
+// one "name:value" line per header, with names lowercased and sorted and
+// surrounding whitespace trimmed. Keys may carry an operator prefix (see Op),
+// which is kept in front of the name; removals are written with an empty value.
+// Backslash, CR, and LF in values are escaped as \\, \r, and \n. Colons need
+// no escaping: lines are split at the first colon, and a header name cannot
+// contain one.
+//
+// The same input always encodes to the same string, so an unchanged
+// _hedge_headers.json produces no KVS updates. If two keys differ only in
+// case, the one that sorts last wins.
+func Encode(fields map[string]string) string {
+	type keyed struct {
+		key string
+		Field
+	}
+	all := make([]keyed, 0, len(fields))
+	for key, value := range fields {
+		op, name := ParseName(key)
+		f := Field{Op: op, Name: canonicalName(name), Value: strings.TrimSpace(value)}
+		if op == OpRemove {
+			f.Value = ""
+		}
+		all = append(all, keyed{key, f})
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].Name != all[j].Name {
+			return all[i].Name < all[j].Name
+		}
+		if all[i].Op != all[j].Op {
+			return all[i].Op.rank() < all[j].Op.rank()
+		}
+		return all[i].key < all[j].key
+	})
+
+	var canonical []Field
+	for _, k := range all {
+		if n := len(canonical); n > 0 && canonical[n-1].Name == k.Name && canonical[n-1].Op == k.Op {
+			canonical[n-1] = k.Field
+			continue
+		}
+		canonical = append(canonical, k.Field)
+	}
+
+	var b strings.Builder
+	b.WriteString(versionLine)
+	for _, f := range canonical {
+		b.WriteString("\n")
+		b.WriteString(f.Op.Prefix())
+		b.WriteString(f.Name)
+		b.WriteString(":")
+		b.WriteString(escapeValue(f.Value))
+	}
+	return b.String()
+}
+
+// Decode parses a value produced by Encode, or a legacy unversioned value of
+// "Name: value" lines, into its header fields. Legacy values only set headers.
+func Decode(value string) ([]Field, error) {
+	lines := strings.Split(value, "\n")
+	versioned := false
+	if strings.HasPrefix(lines[0], "~") {
+		if lines[0] != versionLine {
+			return nil, fmt.Errorf("unsupported header encoding version %q", lines[0][1:])
+		}
+		versioned = true
+		lines = lines[1:]
+	}
+
+	var fields []Field
+	for _, line := range lines {
+		name, val, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		op := OpSet
+		if versioned {
+			op, name = ParseName(name)
+			val = unescapeValue(val)
+		} else {
+			val = strings.TrimSpace(val)
+		}
+		name = canonicalName(name)
+		if name == "" {
+			continue
+		}
+		fields = append(fields, Field{Op: op, Name: name, Value: val})
+	}
+	return fields, nil
+}
+
+// Rules returns header fields as rules keyed as in _hedge_headers.json, with
+// any operator prefix in front of the name. Encode(Rules(fields)) gives back
+// the encoding fields were decoded from.
+func Rules(fields []Field) map[string]string {
+	rules := make(map[string]string, len(fields))
+	for _, f := range fields {
+		rules[f.Op.Prefix()+f.Name] = f.Value
+	}
+	return rules
+}
+
+func canonicalName(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+var valueEscaper = strings.NewReplacer(`\`, `\\`, "\r", `\r`, "\n", `\n`)
+
+func escapeValue(v string) string {
+	return valueEscaper.Replace(v)
+}
+
+func unescapeValue(v string) string {
+	if !strings.Contains(v, `\`) {
+		return v
+	}
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		if v[i] != '\\' || i+1 == len(v) {
+			b.WriteByte(v[i])
+			continue
+		}
+		i++
+		switch v[i] {
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		default:
+			b.WriteByte(v[i])
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,124 @@
+package headers
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEncode_Canonical(t *testing.T) {
+	got := Encode(map[string]string{
+		"X-Frame-Options": "DENY",
+		"Cache-Control":   "  public, max-age=3600 ",
+		"link":            "</a.css>; rel=preload",
+	})
+	want := "~1\ncache-control:public, max-age=3600\nlink:</a.css>; rel=preload\nx-frame-options:DENY"
+	if got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestEncode_Deterministic(t *testing.T) {
+	fields := map[string]string{"A": "1", "B": "2", "C": "3", "D": "4", "E": "5"}
+	first := Encode(fields)
+	for i := 0; i < 20; i++ {
+		if got := Encode(fields); got != first {
+			t.Fatalf("encoding %d differs: %q vs %q", i, got, first)
+		}
+	}
+}
+
+func TestEncode_CaseCollision(t *testing.T) {
+	got := Encode(map[string]string{"Cache-Control": "a", "cache-control": "b"})
+	if want := "~1\ncache-control:b"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestEncode_Empty(t *testing.T) {
+	if got := Encode(nil); got != "~1" {
+		t.Errorf("expected bare version line, got %q", got)
+	}
+}
+
+func TestEncodeDecode_Escaping(t *testing.T) {
+	fields := map[string]string{"X-Odd": "a\\b\nc\rd: e"}
+	encoded := Encode(fields)
+	if want := "~1\nx-odd:a\\\\b\\nc\\rd: e"; encoded != want {
+		t.Errorf("expected %q, got %q", want, encoded)
+	}
+	decoded, err := Decode(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Field{{Name: "x-odd", Value: "a\\b\nc\rd: e"}}
+	if !reflect.DeepEqual(decoded, want) {
+		t.Errorf("expected %v, got %v", want, decoded)
+	}
+}
+
+func TestDecode_Legacy(t *testing.T) {
+	decoded, err := Decode("X-Frame-Options: DENY\nCache-Control: max-age=60\nnot a header")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Field{
+		{Name: "x-frame-options", Value: "DENY"},
+		{Name: "cache-control", Value: "max-age=60"},
+	}
+	if !reflect.DeepEqual(decoded, want) {
+		t.Errorf("expected %v, got %v", want, decoded)
+	}
+}
+
+func TestDecode_UnsupportedVersion(t *testing.T) {
+	if _, err := Decode("~9\na:b"); err == nil {
+		t.Error("expected error for unsupported version")
+	}
+}
+
+func TestEncode_Operators(t *testing.T) {
+	got := Encode(map[string]string{
+		"+Link":   "</b.css>; rel=preload",
+		"Link":    "</a.css>; rel=preload",
+		"!Server": "ignored",
+		"+Vary":   "Accept-Encoding",
+	})
+	// Same-name fields sort remove, set, append
+	want := "~1\nlink:</a.css>; rel=preload\n+link:</b.css>; rel=preload\n!server:\n+vary:Accept-Encoding"
+	if got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+
+	decoded, err := Decode(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantFields := []Field{
+		{Op: OpSet, Name: "link", Value: "</a.css>; rel=preload"},
+		{Op: OpAppend, Name: "link", Value: "</b.css>; rel=preload"},
+		{Op: OpRemove, Name: "server"},
+		{Op: OpAppend, Name: "vary", Value: "Accept-Encoding"},
+	}
+	if !reflect.DeepEqual(decoded, wantFields) {
+		t.Errorf("expected %v, got %v", wantFields, decoded)
+	}
+}
+
+func TestParseName(t *testing.T) {
+	tests := []struct {
+		in     string
+		wantOp Op
+		want   string
+	}{
+		{"Cache-Control", OpSet, "Cache-Control"},
+		{"+Link", OpAppend, "Link"},
+		{"!Server", OpRemove, "Server"},
+		{" +Vary ", OpAppend, "Vary"},
+	}
+	for _, tt := range tests {
+		op, name := ParseName(tt.in)
+		if op != tt.wantOp || name != tt.want {
+			t.Errorf("ParseName(%q) = %v, %q; want %v, %q", tt.in, op, name, tt.wantOp, tt.want)
+		}
+	}
+}
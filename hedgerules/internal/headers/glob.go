@@ -0,0 +1,135 @@
+package headers
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// IsGlob reports whether a _hedge_headers.json key is a scoped glob that
+// Expand must resolve, as opposed to a key stored in the KVS as written.
+// Plain extension wildcards like "*.pdf" are looked up directly.
+func IsGlob(pattern string) bool {
+	return strings.HasPrefix(pattern, "/") && strings.Contains(pattern, "*")
+}
+
+// glob is a parsed scoped glob: Dir is the directory it is rooted at, with
+// a trailing slash; Ext is the extension it matches, or "" for any file.
+type glob struct {
+	Dir       string
+	Ext       string
+	Recursive bool
+}
+
+// parseGlob parses the glob forms Expand supports:
+//
+//	/dir/**           everything under /dir/
+//	/dir/*.ext        files ending in .ext directly in /dir/
+//	/dir/**/*.ext     files ending in .ext anywhere under /dir/
+func parseGlob(pattern string) (glob, error) {
+	dir, last := path.Split(pattern)
+	if last == "**" {
+		if strings.Contains(dir, "*") {
+			return glob{}, fmt.Errorf("unsupported glob %q: wildcards are only allowed in the last segment", pattern)
+		}
+		return glob{Dir: dir, Recursive: true}, nil
+	}
+
+	g := glob{Dir: dir}
+	if strings.HasSuffix(dir, "/**/") {
+		g.Dir = strings.TrimSuffix(dir, "**/")
+		g.Recursive = true
+	}
+	if strings.Contains(g.Dir, "*") {
+		return glob{}, fmt.Errorf("unsupported glob %q: wildcards are only allowed in the last segment", pattern)
+	}
+	ext := strings.TrimPrefix(last, "*.")
+	if ext == last || ext == "" || strings.ContainsAny(ext, "*.") {
+		return glob{}, fmt.Errorf("unsupported glob %q: expected /dir/**, /dir/*.ext, or /dir/**/*.ext", pattern)
+	}
+	g.Ext = ext
+	return g, nil
+}
+
+// Expand resolves the scoped globs in rules into keys viewer-response.js
+// looks up (see Patterns), and returns the rules with globs replaced:
+//
+//   - /dir/** becomes the directory key /dir/
+//   - /dir/*.ext stays as is, since the function looks up the directory-scoped
+//     extension of every request
+//   - /dir/**/*.ext becomes /sub/*.ext for /dir/ and every directory below it
+//     that holds a .ext file, or *.ext when rooted at /
+//
+// files lists the URL path of every file in the site; only directories that
+// hold a matching file get a key, so globs cost no more KVS capacity than
+// listing the files would. When several rules land on the same key, they are
+// layered with Merge, most specific last: a deeper glob over a shallower one,
+// and a rule written with the key itself over any glob.
+func Expand(rules map[string]map[string]string, files []string) (map[string]map[string]string, error) {
+	type expansion struct {
+		key       string
+		depth     int
+		recursive bool
+		rule      map[string]string
+	}
+
+	dirsByExt := make(map[string][]string)
+	for _, f := range files {
+		dir, name := path.Split(f)
+		if dot := strings.LastIndex(name, "."); dot != -1 && dot < len(name)-1 {
+			ext := name[dot+1:]
+			dirsByExt[ext] = append(dirsByExt[ext], dir)
+		}
+	}
+
+	expanded := make(map[string]map[string]string, len(rules))
+	var globs []expansion
+	for pattern, rule := range rules {
+		if !IsGlob(pattern) {
+			expanded[pattern] = rule
+			continue
+		}
+		g, err := parseGlob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		depth := strings.Count(g.Dir, "/")
+		switch {
+		case g.Ext == "":
+			globs = append(globs, expansion{g.Dir, depth, true, rule})
+		case !g.Recursive:
+			globs = append(globs, expansion{g.Dir + "*." + g.Ext, depth, false, rule})
+		case g.Dir == "/":
+			globs = append(globs, expansion{"*." + g.Ext, depth, true, rule})
+		default:
+			seen := make(map[string]bool)
+			for _, dir := range dirsByExt[g.Ext] {
+				if strings.HasPrefix(dir, g.Dir) && !seen[dir] {
+					seen[dir] = true
+					globs = append(globs, expansion{dir + "*." + g.Ext, depth, true, rule})
+				}
+			}
+		}
+	}
+
+	// Layer shallowest first. At the same depth, /dir/**/*.ext is less
+	// specific than /dir/*.ext, which lands on the same key.
+	sort.Slice(globs, func(i, j int) bool {
+		if globs[i].depth != globs[j].depth {
+			return globs[i].depth < globs[j].depth
+		}
+		if globs[i].recursive != globs[j].recursive {
+			return globs[i].recursive
+		}
+		return globs[i].key < globs[j].key
+	})
+	merged := make(map[string]map[string]string)
+	for _, e := range globs {
+		merged[e.key] = Merge(merged[e.key], e.rule)
+	}
+	for key, rule := range merged {
+		expanded[key] = Merge(rule, expanded[key])
+	}
+	return expanded, nil
+}
@@ -0,0 +1,66 @@
+package headers
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpand(t *testing.T) {
+	files := []string{
+		"/index.html",
+		"/docs/intro.pdf",
+		"/docs/guide/manual.pdf",
+		"/docs/guide/index.html",
+		"/blog/post.pdf",
+		"/fonts/a.woff2",
+	}
+	rules := map[string]map[string]string{
+		"/":                    {"X-Frame-Options": "DENY"},
+		"/docs/**/*.pdf":       {"X-Robots-Tag": "noindex", "+Vary": "Accept"},
+		"/docs/guide/*.pdf":    {"+Vary": "Origin"},
+		"/docs/guide/**/*.pdf": {"Cache-Control": "no-store"},
+		"/fonts/**":            {"Cache-Control": "max-age=31536000"},
+		"/fonts/":              {"Access-Control-Allow-Origin": "*"},
+		"/**/*.woff2":          {"X-Font": "yes"},
+	}
+
+	got, err := Expand(rules, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]map[string]string{
+		"/":           {"X-Frame-Options": "DENY"},
+		"/docs/*.pdf": {"X-Robots-Tag": "noindex", "+Vary": "Accept"},
+		"/docs/guide/*.pdf": {
+			"X-Robots-Tag":  "noindex",
+			"Cache-Control": "no-store",
+			"+Vary":         "Accept, Origin",
+		},
+		"/fonts/": {"Cache-Control": "max-age=31536000", "Access-Control-Allow-Origin": "*"},
+		"*.woff2": {"X-Font": "yes"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestExpand_Unsupported(t *testing.T) {
+	for _, pattern := range []string{"/docs/a*.pdf", "/*/index.html", "/docs/**/", "/docs/*", "/docs/*.tar.gz"} {
+		if _, err := Expand(map[string]map[string]string{pattern: {"A": "b"}}, nil); err == nil {
+			t.Errorf("expected error for %q", pattern)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	base := map[string]string{"Vary": "Accept", "+Link": "</a.css>", "!Server": "", "X-A": "1"}
+	over := map[string]string{"+Vary": "Origin", "+Link": "</b.css>", "Server": "edge"}
+	got := Merge(base, over)
+	want := map[string]string{"Vary": "Accept", "+Vary": "Origin", "+Link": "</a.css>, </b.css>", "Server": "edge", "X-A": "1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+	if len(base) != 4 || len(over) != 3 {
+		t.Error("Merge modified its inputs")
+	}
+}
@@ -0,0 +1,117 @@
+package headers
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// readOnly lists the response headers CloudFront Functions can read but not
+// change or remove in a viewer-response event.
+var readOnly = map[string]bool{
+	"content-encoding":  true,
+	"content-length":    true,
+	"transfer-encoding": true,
+	"via":               true,
+	"warning":           true,
+}
+
+// disallowed lists the headers CloudFront does not let functions set.
+var disallowed = map[string]bool{
+	"connection":          true,
+	"expect":              true,
+	"keep-alive":          true,
+	"proxy-authenticate":  true,
+	"proxy-authorization": true,
+	"proxy-connection":    true,
+	"trailer":             true,
+	"upgrade":             true,
+	"x-cache":             true,
+	"x-forwarded-proto":   true,
+	"x-real-ip":           true,
+}
+
+// disallowedPrefixes are header name prefixes reserved by CloudFront.
+var disallowedPrefixes = []string{"x-accel-", "x-amz-cf-", "x-edge-"}
+
+// Lint checks the header rules for one path as written in
+// _hedge_headers.json. It reports names that are not RFC 9110 tokens, values
+// that are not valid field values, names given more than once with the same
+// operator in different case (only one would take effect), and headers
+// CloudFront Functions cannot set or remove. Errors are sorted by header name.
+func Lint(rules map[string]string) []error {
+	keys := make([]string, 0, len(rules))
+	for key := range rules {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var errs []error
+	seen := make(map[string]string)
+	for _, key := range keys {
+		op, name := ParseName(key)
+		if !isToken(name) {
+			errs = append(errs, fmt.Errorf("header name %q is not a valid token", name))
+			continue
+		}
+		canonical := canonicalName(name)
+		if first, ok := seen[op.Prefix()+canonical]; ok {
+			errs = append(errs, fmt.Errorf("header %q duplicates %q (header names are case-insensitive)", key, first))
+		} else {
+			seen[op.Prefix()+canonical] = key
+		}
+		if reason := restricted(canonical); reason != "" {
+			errs = append(errs, fmt.Errorf("header %s %s", name, reason))
+		}
+		if op != OpRemove {
+			if c, ok := invalidValueChar(rules[key]); ok {
+				errs = append(errs, fmt.Errorf("header %s value contains invalid character %q", name, c))
+			}
+		}
+	}
+	return errs
+}
+
+func restricted(name string) string {
+	if readOnly[name] {
+		return "is read-only in CloudFront Functions"
+	}
+	if disallowed[name] {
+		return "cannot be set by CloudFront Functions"
+	}
+	for _, prefix := range disallowedPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return "cannot be set by CloudFront Functions"
+		}
+	}
+	return ""
+}
+
+// isToken reports whether s is an RFC 9110 token: one or more of the
+// characters ! # $ % & ' * + - . ^ _ ` | ~, digits, and letters.
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.IndexByte("!#$%&'*+-.^_`|~", c) != -1:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// invalidValueChar returns the first byte of v that RFC 9110 does not allow
+// in a field value: control characters other than horizontal tab, and DEL.
+func invalidValueChar(v string) (byte, bool) {
+	for i := 0; i < len(v); i++ {
+		if c := v[i]; (c < 0x20 && c != '\t') || c == 0x7f {
+			return c, true
+		}
+	}
+	return 0, false
+}
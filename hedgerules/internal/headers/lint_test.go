@@ -0,0 +1,46 @@
+package headers
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLint_Valid(t *testing.T) {
+	errs := Lint(map[string]string{
+		"Cache-Control":                 "public, max-age=3600",
+		"+Vary":                         "Origin",
+		"Vary":                          "Accept-Encoding",
+		"!Server":                       "",
+		"!X-Amz-Server-Side-Encryption": "",
+		"X-Tab":                         "a\tb",
+		"X-Unicode":                     "héllo",
+	})
+	if len(errs) != 0 {
+		t.Errorf("expected no errors, got %v", errs)
+	}
+}
+
+func TestLint(t *testing.T) {
+	tests := []struct {
+		rules map[string]string
+		want  string
+	}{
+		{map[string]string{"X Bad": "1"}, "not a valid token"},
+		{map[string]string{"X-Colon:": "1"}, "not a valid token"},
+		{map[string]string{"+": "1"}, "not a valid token"},
+		{map[string]string{"X-Split": "a\r\nInjected: yes"}, "invalid character"},
+		{map[string]string{"X-Nul": "a\x00"}, "invalid character"},
+		{map[string]string{"Cache-Control": "a", "cache-control": "b"}, "duplicates"},
+		{map[string]string{"+Vary": "a", "+VARY": "b"}, "duplicates"},
+		{map[string]string{"Content-Length": "10"}, "read-only"},
+		{map[string]string{"!Via": ""}, "read-only"},
+		{map[string]string{"Connection": "close"}, "cannot be set"},
+		{map[string]string{"X-Amz-Cf-Id": "x"}, "cannot be set"},
+	}
+	for _, tt := range tests {
+		errs := Lint(tt.rules)
+		if len(errs) != 1 || !strings.Contains(errs[0].Error(), tt.want) {
+			t.Errorf("Lint(%v): expected one error containing %q, got %v", tt.rules, tt.want, errs)
+		}
+	}
+}
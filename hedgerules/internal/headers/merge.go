@@ -0,0 +1,36 @@
+package headers
+
+// Merge layers the header rules in over on top of base, as if over came from a
+// more specific pattern, and returns the result. Keys are written as in
+// _hedge_headers.json, with optional operator prefixes. A set or remove in
+// over replaces every rule for that header in base; an append keeps them and
+// adds to the end. Neither input is modified.
+func Merge(base, over map[string]string) map[string]string {
+	replaced := make(map[string]bool)
+	for key := range over {
+		if op, name := ParseName(key); op != OpAppend {
+			replaced[canonicalName(name)] = true
+		}
+	}
+
+	merged := make(map[string]string, len(base)+len(over))
+	for key, value := range base {
+		if _, name := ParseName(key); !replaced[canonicalName(name)] {
+			merged[key] = value
+		}
+	}
+	for key, value := range over {
+		if op, name := ParseName(key); op == OpAppend {
+			// Appending on top of an append from base: chain the values so
+			// both survive in one rule.
+			for baseKey, baseValue := range merged {
+				if bop, bname := ParseName(baseKey); bop == OpAppend && canonicalName(bname) == canonicalName(name) {
+					delete(merged, baseKey)
+					value = baseValue + ", " + value
+				}
+			}
+		}
+		merged[key] = value
+	}
+	return merged
+}
@@ -0,0 +1,126 @@
+package headers
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// presets are named sets of security headers, selected with the security
+// key in hedgerules.toml and applied beneath the rules for "/".
+var presets = map[string]map[string]string{
+	"basic": {
+		"Strict-Transport-Security": "max-age=31536000",
+		"X-Content-Type-Options":    "nosniff",
+		"X-Frame-Options":           "SAMEORIGIN",
+		"Referrer-Policy":           "strict-origin-when-cross-origin",
+	},
+	"strict": {
+		"Strict-Transport-Security":  "max-age=63072000; includeSubDomains; preload",
+		"X-Content-Type-Options":     "nosniff",
+		"X-Frame-Options":            "DENY",
+		"Referrer-Policy":            "no-referrer",
+		"Permissions-Policy":         "camera=(), geolocation=(), microphone=(), payment=(), usb=()",
+		"Content-Security-Policy":    "default-src 'self'; base-uri 'self'; form-action 'self'; frame-ancestors 'none'; object-src 'none'",
+		"Cross-Origin-Opener-Policy": "same-origin",
+	},
+}
+
+// PresetNames returns the names of the security presets, sorted.
+func PresetNames() []string {
+	names := make([]string, 0, len(presets))
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Preset returns a copy of the header rules for a named security preset.
+func Preset(name string) (map[string]string, error) {
+	preset, ok := presets[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown security preset %q (want one of %s)", name, strings.Join(PresetNames(), ", "))
+	}
+	rules := make(map[string]string, len(preset))
+	for k, v := range preset {
+		rules[k] = v
+	}
+	return rules, nil
+}
+
+// minHSTSMaxAge is the shortest HSTS max-age LintPolicy accepts, one year,
+// which is also what the HSTS preload list requires.
+const minHSTSMaxAge = 31536000
+
+// LintPolicy returns warnings about weak or contradictory security headers
+// in a header set: a short or missing HSTS max-age, HSTS preload without
+// includeSubDomains, a CSP that allows inline or eval'd scripts or does not
+// set frame-ancestors, and an X-Frame-Options that disagrees with
+// frame-ancestors. Only headers the set sets are checked.
+func LintPolicy(fields []Field) []string {
+	set := make(map[string]string)
+	for _, f := range fields {
+		if f.Op == OpSet {
+			set[f.Name] = f.Value
+		}
+	}
+
+	var warnings []string
+	if hsts, ok := set["strict-transport-security"]; ok {
+		directives := parseDirectives(hsts, ";", "=")
+		maxAge, err := strconv.Atoi(strings.Trim(directives["max-age"], `"`))
+		switch {
+		case err != nil:
+			warnings = append(warnings, "Strict-Transport-Security has no valid max-age")
+		case maxAge < minHSTSMaxAge:
+			warnings = append(warnings, fmt.Sprintf("Strict-Transport-Security max-age=%d is shorter than one year (%d)", maxAge, minHSTSMaxAge))
+		}
+		if _, preload := directives["preload"]; preload {
+			if _, sub := directives["includesubdomains"]; !sub {
+				warnings = append(warnings, "Strict-Transport-Security has preload without includeSubDomains, which the preload list requires")
+			}
+		}
+	}
+
+	if csp, ok := set["content-security-policy"]; ok {
+		directives := parseDirectives(csp, ";", " ")
+		scripts, ok := directives["script-src"]
+		if !ok {
+			scripts = directives["default-src"]
+		}
+		if strings.Contains(scripts, "'unsafe-inline'") && !strings.Contains(scripts, "'nonce-") && !strings.Contains(scripts, "'sha") {
+			warnings = append(warnings, "Content-Security-Policy allows 'unsafe-inline' scripts")
+		}
+		if strings.Contains(scripts, "'unsafe-eval'") {
+			warnings = append(warnings, "Content-Security-Policy allows 'unsafe-eval' scripts")
+		}
+		ancestors, ok := directives["frame-ancestors"]
+		if !ok {
+			warnings = append(warnings, "Content-Security-Policy does not set frame-ancestors")
+		} else if xfo, ok := set["x-frame-options"]; ok {
+			if strings.EqualFold(xfo, "DENY") && ancestors != "'none'" {
+				warnings = append(warnings, fmt.Sprintf("X-Frame-Options DENY contradicts frame-ancestors %s", ancestors))
+			} else if strings.EqualFold(xfo, "SAMEORIGIN") && ancestors == "'none'" {
+				warnings = append(warnings, "X-Frame-Options SAMEORIGIN contradicts frame-ancestors 'none'")
+			}
+		}
+	}
+	return warnings
+}
+
+// parseDirectives splits a header value like "max-age=60; preload" into
+// lowercased directive names and their values.
+func parseDirectives(value, sep, assign string) map[string]string {
+	directives := make(map[string]string)
+	for _, d := range strings.Split(value, sep) {
+		d = strings.TrimSpace(d)
+		if d == "" {
+			continue
+		}
+		name, val, _ := strings.Cut(d, assign)
+		directives[strings.ToLower(strings.TrimSpace(name))] = strings.TrimSpace(val)
+	}
+	return directives
+}
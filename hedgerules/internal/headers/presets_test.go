@@ -0,0 +1,60 @@
+package headers
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPreset(t *testing.T) {
+	for _, name := range PresetNames() {
+		rules, err := Preset(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if errs := Lint(rules); len(errs) != 0 {
+			t.Errorf("preset %s: lint errors %v", name, errs)
+		}
+		fields, _ := Decode(Encode(rules))
+		if warnings := LintPolicy(fields); len(warnings) != 0 {
+			t.Errorf("preset %s: policy warnings %v", name, warnings)
+		}
+		// Callers may modify the returned rules
+		rules["X-Test"] = "1"
+		if again, _ := Preset(name); again["X-Test"] != "" {
+			t.Errorf("preset %s was modified through a returned copy", name)
+		}
+	}
+	if _, err := Preset("paranoid"); err == nil {
+		t.Error("expected error for unknown preset")
+	}
+}
+
+func TestLintPolicy(t *testing.T) {
+	tests := []struct {
+		rules map[string]string
+		want  []string
+	}{
+		{map[string]string{"Strict-Transport-Security": "max-age=300"}, []string{"shorter than one year"}},
+		{map[string]string{"Strict-Transport-Security": "includeSubDomains"}, []string{"no valid max-age"}},
+		{map[string]string{"Strict-Transport-Security": "max-age=63072000; preload"}, []string{"preload without includeSubDomains"}},
+		{map[string]string{"Content-Security-Policy": "default-src 'self' 'unsafe-inline'; frame-ancestors 'self'"}, []string{"'unsafe-inline'"}},
+		{map[string]string{"Content-Security-Policy": "script-src 'self' 'unsafe-inline' 'nonce-abc'; frame-ancestors 'self'"}, nil},
+		{map[string]string{"Content-Security-Policy": "script-src 'unsafe-eval'"}, []string{"'unsafe-eval'", "does not set frame-ancestors"}},
+		{map[string]string{"Content-Security-Policy": "frame-ancestors 'self'", "X-Frame-Options": "DENY"}, []string{"DENY contradicts"}},
+		{map[string]string{"Content-Security-Policy": "frame-ancestors 'none'", "X-Frame-Options": "SAMEORIGIN"}, []string{"SAMEORIGIN contradicts"}},
+		{map[string]string{"+Content-Security-Policy": "script-src 'unsafe-eval'"}, nil},
+	}
+	for _, tt := range tests {
+		fields, _ := Decode(Encode(tt.rules))
+		got := LintPolicy(fields)
+		if len(got) != len(tt.want) {
+			t.Errorf("LintPolicy(%v): expected %d warnings, got %v", tt.rules, len(tt.want), got)
+			continue
+		}
+		for i := range tt.want {
+			if !strings.Contains(got[i], tt.want[i]) {
+				t.Errorf("LintPolicy(%v): warning %d: expected %q, got %q", tt.rules, i, tt.want[i], got[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package headers
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Budget is the most bytes of headers viewer-response.js adds to a single
+// response, counting each header as name + value + 4. It must match
+// headerSizeLimitBytes in the function.
+const Budget = 4096
+
+// tokenPattern matches "{{", which escapes a literal "{", and tokens such as
+// "{host}" or "{/path}". Braces around anything else, like JSON in a
+// Report-To value, are left alone. viewer-response.js uses the same pattern.
+var tokenPattern = regexp.MustCompile(`\{\{|\{(/?[a-z]+)\}`)
+
+// TokenMaxBytes is the longest value each request token can expand to, used
+// to estimate the worst-case size of a header set.
+var TokenMaxBytes = map[string]int{
+	"/path":    512,
+	"/dir":     512,
+	"basename": 255,
+	"host":     253,
+	"query":    1024,
+	"country":  2,
+	"status":   3,
+}
+
+// ExpandTokens replaces every token in value with its value from vars, and
+// every "{{" with "{", as viewer-response.js does. Tokens missing from vars
+// are left as is.
+func ExpandTokens(value string, vars map[string]string) string {
+	return tokenPattern.ReplaceAllStringFunc(value, func(m string) string {
+		if m == "{{" {
+			return "{"
+		}
+		if v, ok := vars[m[1:len(m)-1]]; ok {
+			return v
+		}
+		return m
+	})
+}
+
+// CheckTokens returns an error if value uses a token viewer-response.js
+// does not know.
+func CheckTokens(value string) error {
+	for _, m := range tokenPattern.FindAllStringSubmatch(value, -1) {
+		if m[1] != "" {
+			if _, ok := TokenMaxBytes[m[1]]; !ok {
+				return fmt.Errorf("unknown token {%s} (write {{ for a literal brace)", m[1])
+			}
+		}
+	}
+	return nil
+}
+
+// WorstCaseSize returns the most bytes a header set can add to a response,
+// with every token expanded to its longest value. Removals add nothing.
+func WorstCaseSize(fields []Field) int {
+	longest := make(map[string]string, len(TokenMaxBytes))
+	for name, n := range TokenMaxBytes {
+		longest[name] = strings.Repeat("x", n)
+	}
+	size := 0
+	for _, f := range fields {
+		if f.Op != OpRemove {
+			size += len(f.Name) + len(ExpandTokens(f.Value, longest)) + 4
+		}
+	}
+	return size
+}
+
+// CheckValue validates an encoded header set: every token must be known, and
+// the worst-case expanded size must fit in Budget. References (see Ref) are
+// valid; the set they point to is checked under its own key.
+func CheckValue(value string) error {
+	if IsRef(value) {
+		return nil
+	}
+	fields, err := Decode(value)
+	if err != nil {
+		return err
+	}
+	for _, f := range fields {
+		if err := CheckTokens(f.Value); err != nil {
+			return fmt.Errorf("header %s: %w", f.Name, err)
+		}
+	}
+	if size := WorstCaseSize(fields); size > Budget {
+		return fmt.Errorf("headers may expand to %d bytes, more than the %d-byte header budget", size, Budget)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package headers
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExpandTokens(t *testing.T) {
+	vars := map[string]string{"/path": "/docs/", "host": "example.com", "query": "a=1"}
+	tests := []struct {
+		in, want string
+	}{
+		{"https://{host}{/path}", "https://example.com/docs/"},
+		{"{/path} and {/path}", "/docs/ and /docs/"},
+		{"{{host} is literal", "{host} is literal"},
+		{"?{query}", "?a=1"},
+		{`{"group":"default"}`, `{"group":"default"}`},
+		{"{unknown}", "{unknown}"},
+	}
+	for _, tt := range tests {
+		if got := ExpandTokens(tt.in, vars); got != tt.want {
+			t.Errorf("ExpandTokens(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestCheckTokens(t *testing.T) {
+	valid := []string{"{/path}{/dir}{basename}{host}{query}{country}{status}", "{{nope}", `{"a":1}`, "plain"}
+	for _, v := range valid {
+		if err := CheckTokens(v); err != nil {
+			t.Errorf("CheckTokens(%q): unexpected error %v", v, err)
+		}
+	}
+	if err := CheckTokens("{/pth}"); err == nil {
+		t.Error("expected error for unknown token")
+	}
+}
+
+func TestCheckValue(t *testing.T) {
+	if err := CheckValue(Encode(map[string]string{"Onion-Location": "http://x.onion{/path}"})); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := CheckValue(Encode(map[string]string{"X-Where": "{hots}"})); err == nil {
+		t.Error("expected error for unknown token")
+	}
+
+	// Four query tokens fit in a KVS value but may expand past the budget
+	big := Encode(map[string]string{"X-Query": strings.Repeat("{query}", 4)})
+	if err := CheckValue(big); err == nil || !strings.Contains(err.Error(), "header budget") {
+		t.Errorf("expected budget error, got %v", err)
+	}
+
+	// Removals add nothing
+	if size := WorstCaseSize([]Field{{Op: OpRemove, Name: "server"}}); size != 0 {
+		t.Errorf("expected 0 for a removal, got %d", size)
+	}
+}
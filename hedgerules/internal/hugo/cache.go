@@ -0,0 +1,90 @@
+package hugo
+
+import (
+	"path"
+	"regexp"
+	"strings"
+)
+
+// DefaultImmutableCacheControl is the Cache-Control for fingerprinted files
+// when CacheConfig.Immutable is unset.
+const DefaultImmutableCacheControl = "public, max-age=31536000, immutable"
+
+// CacheConfig is the [cache] table of hedgerules.toml.
+type CacheConfig struct {
+	// Fingerprinted turns on immutable Cache-Control rules for files whose
+	// names carry a content hash, like main.3f2a9c1d.css from Hugo Pipes.
+	Fingerprinted bool `toml:"fingerprinted"`
+	// Immutable overrides DefaultImmutableCacheControl.
+	Immutable string `toml:"immutable"`
+	// Default, if set, is the Cache-Control for everything else.
+	Default string `toml:"default"`
+}
+
+// fingerprintPattern matches a hex content hash of at least 8 digits as the
+// second-to-last dot-separated part of a file name, e.g. main.3f2a9c1d.css.
+var fingerprintPattern = regexp.MustCompile(`\.([0-9a-f]{8,})\.[^.]+$`)
+
+// IsFingerprinted reports whether a file name carries a content hash. A hash
+// has both digits and letters: all-digit parts like the date in
+// report.20240101.pdf, and words spelled in hex letters like the one in
+// site.facade.css, are not hashes.
+func IsFingerprinted(name string) bool {
+	m := fingerprintPattern.FindStringSubmatch(name)
+	return m != nil && strings.ContainsAny(m[1], "abcdef") && strings.ContainsAny(m[1], "0123456789")
+}
+
+// Rules returns Cache-Control header rules for files, a list of URL paths,
+// to merge beneath _hedge_headers.json. Fingerprinted files get Immutable:
+// under the directory-scoped extension key (e.g. /css/*.css) where every
+// file with that extension in the directory is fingerprinted, and under
+// their own path otherwise. Default goes on "/".
+func (c CacheConfig) Rules(files []string) map[string]map[string]string {
+	rules := make(map[string]map[string]string)
+	if c.Default != "" {
+		rules["/"] = map[string]string{"Cache-Control": c.Default}
+	}
+	if !c.Fingerprinted {
+		return rules
+	}
+	immutable := c.Immutable
+	if immutable == "" {
+		immutable = DefaultImmutableCacheControl
+	}
+
+	// Group files by their directory-scoped extension key
+	type group struct {
+		fingerprinted []string
+		all           bool
+	}
+	groups := make(map[string]*group)
+	for _, f := range files {
+		dir, name := path.Split(f)
+		ext := path.Ext(name)
+		if ext == "" || ext == "." {
+			continue
+		}
+		key := dir + "*" + ext
+		g, ok := groups[key]
+		if !ok {
+			g = &group{all: true}
+			groups[key] = g
+		}
+		if IsFingerprinted(name) {
+			g.fingerprinted = append(g.fingerprinted, f)
+		} else {
+			g.all = false
+		}
+	}
+
+	for key, g := range groups {
+		if g.all {
+			rules[key] = map[string]string{"Cache-Control": immutable}
+			continue
+		}
+		for _, f := range g.fingerprinted {
+			rules[f] = map[string]string{"Cache-Control": immutable}
+		}
+	}
+	return rules
+}
@@ -0,0 +1,53 @@
+package hugo
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestIsFingerprinted(t *testing.T) {
+	tests := map[string]bool{
+		"main.3f2a9c1d.css":                            true,
+		"main.min.3f2a9c1d0b1e4f5a3f2a9c1d0b1e4f5a.js": true,
+		"font.abcdef01.woff2":                          true,
+		"main.css":                                     false,
+		"report.20240101.pdf":                          false,
+		"main.3f2a9.css":                               false,
+		"main.3f2a9c.css":                              false,
+		"site.facade.css":                              false,
+		"logo.decade.png":                              false,
+		"bg.deadbeef.png":                              false,
+		"main.3F2A9C.css":                              false,
+		"index.html":                                   false,
+	}
+	for name, want := range tests {
+		if got := IsFingerprinted(name); got != want {
+			t.Errorf("IsFingerprinted(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestCacheConfigRules(t *testing.T) {
+	files := []string{
+		"/index.html",
+		"/css/main.3f2a9c1d.css",
+		"/css/print.4e5d6f70.css",
+		"/js/app.a1b2c3d4.js",
+		"/js/vendor.js",
+		"/fonts/inter.woff2",
+	}
+	c := CacheConfig{Fingerprinted: true, Default: "public, max-age=300"}
+	want := map[string]map[string]string{
+		"/":                   {"Cache-Control": "public, max-age=300"},
+		"/css/*.css":          {"Cache-Control": DefaultImmutableCacheControl},
+		"/js/app.a1b2c3d4.js": {"Cache-Control": DefaultImmutableCacheControl},
+	}
+	if got := c.Rules(files); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	c = CacheConfig{Immutable: "max-age=60"}
+	if got := c.Rules(files); len(got) != 0 {
+		t.Errorf("expected no rules when disabled, got %v", got)
+	}
+}
@@ -0,0 +1,176 @@
+package hugo
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/mrled/hedgerules/hedgerules/internal/headers"
+	"github.com/mrled/hedgerules/hedgerules/internal/kvs"
+)
+
+// InlineHashes are the CSP hash sources, like 'sha256-...', of the inline
+// scripts and styles in one page.
+type InlineHashes struct {
+	Scripts []string
+	Styles  []string
+}
+
+var (
+	inlineScriptPattern = regexp.MustCompile(`(?is)<script\b([^>]*)>(.*?)</script\s*>`)
+	inlineStylePattern  = regexp.MustCompile(`(?is)<style\b([^>]*)>(.*?)</style\s*>`)
+	srcAttrPattern      = regexp.MustCompile(`(?i)\ssrc\s*=`)
+	typeAttrPattern     = regexp.MustCompile(`(?i)\stype\s*=\s*["']?([^"'\s>]*)`)
+)
+
+// scriptTypes are the <script> types browsers execute, and so CSP applies to.
+// Other types, like application/ld+json, are data blocks.
+var scriptTypes = map[string]bool{
+	"":                       true,
+	"module":                 true,
+	"text/javascript":        true,
+	"application/javascript": true,
+	"text/ecmascript":        true,
+	"application/ecmascript": true,
+}
+
+// ScanInlineHashes walks outputDir and returns the hashes of the inline
+// <script> and <style> blocks in every HTML file, keyed by the file's URL
+// path, e.g. "/blog/index.html". Files without inline blocks are omitted.
+func ScanInlineHashes(outputDir string) (map[string]InlineHashes, error) {
+	pages := make(map[string]InlineHashes)
+	err := filepath.WalkDir(outputDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.EqualFold(filepath.Ext(path), ".html") {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(outputDir, path)
+		if err != nil {
+			return err
+		}
+
+		var h InlineHashes
+		for _, m := range inlineScriptPattern.FindAllStringSubmatch(string(data), -1) {
+			attrs, body := m[1], m[2]
+			if srcAttrPattern.MatchString(attrs) || body == "" {
+				continue
+			}
+			scriptType := ""
+			if t := typeAttrPattern.FindStringSubmatch(attrs); t != nil {
+				scriptType = strings.ToLower(t[1])
+			}
+			if scriptTypes[scriptType] {
+				h.Scripts = appendUnique(h.Scripts, cspHash(body))
+			}
+		}
+		for _, m := range inlineStylePattern.FindAllStringSubmatch(string(data), -1) {
+			if m[2] != "" {
+				h.Styles = appendUnique(h.Styles, cspHash(m[2]))
+			}
+		}
+		if len(h.Scripts) > 0 || len(h.Styles) > 0 {
+			pages["/"+filepath.ToSlash(rel)] = h
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("scanning HTML for inline scripts and styles: %w", err)
+	}
+	return pages, nil
+}
+
+// AddCSPHashes adds each page's inline hashes to the Content-Security-Policy
+// the page gets from the header cascade, and stores the result under the
+// page's own path, the most specific pattern. Pages whose CSP would not fit
+// in one KVS entry are reported as errors and left as they were. Pages with
+// no CSP are left alone, as are pages whose CSP does not restrict scripts or
+// styles; pages whose CSP is appended to (+Content-Security-Policy) are
+// reported as errors, since the hashes can only go in one policy. A
+// directive that allows 'unsafe-inline' gets no hashes, which would turn it
+// off, and is reported as a warning (see headers.AddCSPSources).
+func AddCSPHashes(entries []kvs.Entry, hashes map[string]InlineHashes) ([]kvs.Entry, []kvs.ValidationError, []kvs.ValidationError) {
+	store := entryMap(entries)
+	var errs, warnings []kvs.ValidationError
+	for _, page := range sortedKeys(hashes) {
+		set, ok, err := headers.Effective(page, store)
+		if err != nil {
+			errs = append(errs, kvs.ValidationError{Key: page, Message: err.Error()})
+			continue
+		}
+		if !ok {
+			continue
+		}
+		fields, err := headers.Decode(set)
+		if err != nil {
+			errs = append(errs, kvs.ValidationError{Key: page, Message: err.Error()})
+			continue
+		}
+		rules := headers.Rules(fields)
+		if _, ok := rules["+content-security-policy"]; ok {
+			errs = append(errs, kvs.ValidationError{Key: page, Message: "cannot add inline hashes to an appended Content-Security-Policy"})
+			continue
+		}
+		csp, ok := rules["content-security-policy"]
+		if !ok {
+			continue
+		}
+		h := hashes[page]
+		updated, err := headers.AddCSPSources(csp, "script-src", h.Scripts)
+		if err != nil {
+			warnings = append(warnings, kvs.ValidationError{Key: page, Message: err.Error()})
+		}
+		updated, err = headers.AddCSPSources(updated, "style-src", h.Styles)
+		if err != nil {
+			warnings = append(warnings, kvs.ValidationError{Key: page, Message: err.Error()})
+		}
+		if updated == csp {
+			continue
+		}
+
+		own := map[string]string{}
+		if value, ok := store[page]; ok {
+			pageFields, err := headers.Decode(value)
+			if err != nil {
+				errs = append(errs, kvs.ValidationError{Key: page, Message: err.Error()})
+				continue
+			}
+			own = headers.Rules(pageFields)
+		}
+		own = headers.Merge(own, map[string]string{"content-security-policy": updated})
+		value := headers.Encode(own)
+		if size := len(page) + len(value); size > kvs.MaxEntryBytes {
+			errs = append(errs, kvs.ValidationError{
+				Key: page,
+				Message: fmt.Sprintf("Content-Security-Policy with %d inline hashes makes the entry %d bytes, over the %d-byte KVS entry limit",
+					len(h.Scripts)+len(h.Styles), size, kvs.MaxEntryBytes),
+			})
+			continue
+		}
+		store[page] = value
+	}
+	return sortedEntries(store), errs, warnings
+}
+
+func cspHash(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return "'sha256-" + base64.StdEncoding.EncodeToString(sum[:]) + "'"
+}
+
+func appendUnique(list []string, s string) []string {
+	for _, v := range list {
+		if v == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
@@ -0,0 +1,104 @@
+package hugo
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mrled/hedgerules/hedgerules/internal/headers"
+	"github.com/mrled/hedgerules/hedgerules/internal/kvs"
+)
+
+func TestScanInlineHashes(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "blog"), 0755)
+	page := `<html><head>
+<style>body{color:red}</style>
+<script src="/main.js"></script>
+<script type="application/ld+json">{"@type":"Blog"}</script>
+<SCRIPT type="module">alert(1)</SCRIPT>
+<script>alert(1)</script>
+</head></html>`
+	os.WriteFile(filepath.Join(dir, "blog", "index.html"), []byte(page), 0644)
+	os.WriteFile(filepath.Join(dir, "index.html"), []byte("<html><script src=/a.js></script></html>"), 0644)
+	os.WriteFile(filepath.Join(dir, "main.js"), []byte("<script>not html</script>"), 0644)
+
+	hashes, err := ScanInlineHashes(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]InlineHashes{
+		"/blog/index.html": {
+			Scripts: []string{cspHash("alert(1)")},
+			Styles:  []string{cspHash("body{color:red}")},
+		},
+	}
+	if !reflect.DeepEqual(hashes, want) {
+		t.Errorf("expected %v, got %v", want, hashes)
+	}
+	// echo -n 'alert(1)' | openssl dgst -sha256 -binary | base64
+	if got := cspHash("alert(1)"); got != "'sha256-bhHHL3z2vDgxUt0W3dWQOrprscmda2Y5pLsLg4GF+pI='" {
+		t.Errorf("unexpected hash %s", got)
+	}
+}
+
+func TestAddCSPHashes(t *testing.T) {
+	entries := []kvs.Entry{
+		{Key: "/", Value: headers.Encode(map[string]string{"Content-Security-Policy": "default-src 'self'; frame-ancestors 'none'"})},
+		{Key: "/blog/index.html", Value: headers.Encode(map[string]string{"X-Page": "1"})},
+		{Key: "/open/", Value: headers.Encode(map[string]string{"!Content-Security-Policy": ""})},
+	}
+	hashes := map[string]InlineHashes{
+		"/blog/index.html":  {Scripts: []string{"'sha256-a'"}},
+		"/about/index.html": {Styles: []string{"'sha256-b'"}},
+		"/open/index.html":  {Scripts: []string{"'sha256-c'"}},
+		"/big/index.html":   {Scripts: []string{strings.Repeat("x", 1000)}},
+	}
+
+	got, errs, warnings := AddCSPHashes(entries, hashes)
+	if len(warnings) != 0 {
+		t.Errorf("expected no warnings, got %v", warnings)
+	}
+	if len(errs) != 1 || errs[0].Key != "/big/index.html" || !strings.Contains(errs[0].Message, "KVS entry limit") {
+		t.Errorf("expected one size error for /big/index.html, got %v", errs)
+	}
+	result := entryMap(got)
+	if want := "~1\ncontent-security-policy:default-src 'self'; frame-ancestors 'none'; script-src 'self' 'sha256-a'\nx-page:1"; result["/blog/index.html"] != want {
+		t.Errorf("blog: expected %q, got %q", want, result["/blog/index.html"])
+	}
+	if want := "~1\ncontent-security-policy:default-src 'self'; frame-ancestors 'none'; style-src 'self' 'sha256-b'"; result["/about/index.html"] != want {
+		t.Errorf("about: expected %q, got %q", want, result["/about/index.html"])
+	}
+	if _, ok := result["/open/index.html"]; ok {
+		t.Error("expected no entry for a page without a CSP")
+	}
+	if _, ok := result["/big/index.html"]; ok {
+		t.Error("expected no entry for a page whose CSP is too large")
+	}
+}
+
+func TestAddCSPHashes_UnsafeInline(t *testing.T) {
+	csp := "default-src 'self'; style-src 'self' 'unsafe-inline'"
+	entries := []kvs.Entry{{Key: "/", Value: headers.Encode(map[string]string{"Content-Security-Policy": csp})}}
+	hashes := map[string]InlineHashes{
+		"/a.html": {Styles: []string{"'sha256-b'"}},
+		"/b.html": {Scripts: []string{"'sha256-a'"}, Styles: []string{"'sha256-b'"}},
+	}
+
+	got, errs, warnings := AddCSPHashes(entries, hashes)
+	if len(errs) != 0 {
+		t.Errorf("expected no errors, got %v", errs)
+	}
+	if len(warnings) != 2 || warnings[0].Key != "/a.html" || !strings.Contains(warnings[0].Message, "'unsafe-inline'") {
+		t.Errorf("expected a warning for each page's style-src, got %v", warnings)
+	}
+	result := entryMap(got)
+	if _, ok := result["/a.html"]; ok {
+		t.Error("expected no entry for a page with only styles to hash")
+	}
+	if want := "~1\ncontent-security-policy:default-src 'self'; style-src 'self' 'unsafe-inline'; script-src 'self' 'sha256-a'"; result["/b.html"] != want {
+		t.Errorf("expected only script hashes, got %q", result["/b.html"])
+	}
+}
@@ -51,3 +51,27 @@ func ScanDirectories(outputDir string) ([]kvs.Entry, error) {
 
 	return entries, nil
 }
+
+// ScanFiles walks outputDir and returns the URL path of every file in it,
+// e.g. "/blog/index.html".
+func ScanFiles(outputDir string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(outputDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(outputDir, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, "/"+filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("walking output directory: %w", err)
+	}
+	return files, nil
+}
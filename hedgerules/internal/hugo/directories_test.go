@@ -69,3 +69,26 @@ func TestScanDirectories_NotExists(t *testing.T) {
 		t.Error("expected error for nonexistent directory")
 	}
 }
+
+func TestScanFiles(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "docs", "guide"), 0755)
+	os.WriteFile(filepath.Join(dir, "index.html"), []byte("<html>"), 0644)
+	os.WriteFile(filepath.Join(dir, "docs", "guide", "manual.pdf"), []byte("%PDF"), 0644)
+
+	files, err := ScanFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+
+	expected := []string{"/docs/guide/manual.pdf", "/index.html"}
+	if len(files) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, files)
+	}
+	for i := range expected {
+		if files[i] != expected[i] {
+			t.Errorf("file %d: expected %s, got %s", i, expected[i], files[i])
+		}
+	}
+}
@@ -5,41 +5,270 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
+	"github.com/mrled/hedgerules/hedgerules/internal/headers"
 	"github.com/mrled/hedgerules/hedgerules/internal/kvs"
 )
 
 // ParseHeaders reads _hedge_headers.json and returns header entries.
 // The JSON format is: { "/path": { "Header-Name": "value", ... }, ... }
-// Each entry's value is newline-delimited "Header-Name: value" strings.
-func ParseHeaders(outputDir string) ([]kvs.Entry, error) {
+// Paths may be scoped globs such as "/docs/**/*.pdf", which are expanded
+// against the files in outputDir (see headers.Expand).
+// Each entry's value is the canonical encoding from headers.Encode, so the
+// same input always produces the same entries.
+//
+// Rules in base, such as a security preset, go beneath the rules in the
+// file: they are merged beneath the rules for the same path (see
+// headers.Merge), and a header the file sets on a less specific pattern that
+// covers the same paths (see headers.Beneath) is left out, so that it is not
+// overridden by the more specific base rule. Base keys are stored as
+// written, not expanded as globs.
+//
+// Problems with header names and values (see headers.Lint) are returned as
+// validation errors keyed by the path as written, alongside the entries; the
+// error is only for a file that cannot be read or parsed.
+func ParseHeaders(outputDir string, base map[string]map[string]string) ([]kvs.Entry, []kvs.ValidationError, error) {
 	path := filepath.Join(outputDir, "_hedge_headers.json")
 
+	var raw map[string]map[string]string
 	data, err := os.ReadFile(path)
-	if os.IsNotExist(err) {
-		return nil, nil // No headers file is fine
+	switch {
+	case os.IsNotExist(err):
+		// No headers file is fine
+	case err != nil:
+		return nil, nil, fmt.Errorf("reading %s: %w", path, err)
+	default:
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return nil, nil, fmt.Errorf("parsing %s: %w", path, err)
+		}
 	}
-	if err != nil {
-		return nil, fmt.Errorf("reading %s: %w", path, err)
+
+	var lintErrors []kvs.ValidationError
+	for _, pattern := range sortedKeys(raw) {
+		for _, err := range headers.Lint(raw[pattern]) {
+			lintErrors = append(lintErrors, kvs.ValidationError{Key: pattern, Message: err.Error()})
+		}
 	}
 
-	var raw map[string]map[string]string
-	if err := json.Unmarshal(data, &raw); err != nil {
-		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	for pattern := range raw {
+		if headers.IsGlob(pattern) {
+			files, err := ScanFiles(outputDir)
+			if err != nil {
+				return nil, nil, err
+			}
+			if raw, err = headers.Expand(raw, files); err != nil {
+				return nil, nil, fmt.Errorf("parsing %s: %w", path, err)
+			}
+			break
+		}
+	}
+
+	if len(base) > 0 && raw == nil {
+		raw = make(map[string]map[string]string, len(base))
+	}
+	for pattern, rules := range base {
+		if rules = uncovered(rules, pattern, raw); len(rules) > 0 {
+			raw[pattern] = headers.Merge(rules, raw[pattern])
+		}
 	}
 
 	var entries []kvs.Entry
 	for urlPath, headerMap := range raw {
-		var lines []string
-		for name, value := range headerMap {
-			lines = append(lines, fmt.Sprintf("%s: %s", name, value))
-		}
 		entries = append(entries, kvs.Entry{
 			Key:   urlPath,
-			Value: strings.Join(lines, "\n"),
+			Value: headers.Encode(headerMap),
 		})
 	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+
+	return entries, lintErrors, nil
+}
+
+// uncovered returns the headers of the base rule for pattern that none of
+// the patterns beneath it in rules sets or removes.
+func uncovered(base map[string]string, pattern string, rules map[string]map[string]string) map[string]string {
+	covered := make(map[string]bool)
+	for _, p := range headers.Beneath(pattern) {
+		for key := range rules[p] {
+			if op, name := headers.ParseName(key); op != headers.OpAppend {
+				covered[strings.ToLower(strings.TrimSpace(name))] = true
+			}
+		}
+	}
+	kept := make(map[string]string, len(base))
+	for key, value := range base {
+		if _, name := headers.ParseName(key); !covered[strings.ToLower(strings.TrimSpace(name))] {
+			kept[key] = value
+		}
+	}
+	return kept
+}
+
+// CheckLookups returns a warning for each file whose request would need more
+// than headers.MaxLookups KVS lookups in viewer-response.js, given the header
+// entries it would find.
+func CheckLookups(files []string, entries []kvs.Entry) []kvs.ValidationError {
+	store := entryMap(entries)
+	scopedGlobs := headers.HasScopedGlobs(store)
+	var errs []kvs.ValidationError
+	for _, f := range files {
+		if n := headers.Lookups(f, store, scopedGlobs); n > headers.MaxLookups {
+			errs = append(errs, kvs.ValidationError{
+				Key:     f,
+				Message: fmt.Sprintf("path needs %d header lookups, more than the %d recommended; each one adds to viewer-response's compute time", n, headers.MaxLookups),
+			})
+		}
+	}
+	return errs
+}
+
+// PolicyWarnings returns a warning for each weak or contradictory security
+// header setting in the header entries (see headers.LintPolicy).
+func PolicyWarnings(entries []kvs.Entry) []kvs.ValidationError {
+	var warnings []kvs.ValidationError
+	for _, e := range entries {
+		fields, err := headers.Decode(e.Value)
+		if err != nil {
+			continue // Reported by validation
+		}
+		for _, w := range headers.LintPolicy(fields) {
+			warnings = append(warnings, kvs.ValidationError{Key: e.Key, Message: w})
+		}
+	}
+	return warnings
+}
+
+// HeaderUsage is the largest worst-case header size any file gets from the
+// header cascade, and the file that gets it.
+type HeaderUsage struct {
+	Path string
+	Size int
+}
+
+// CheckHeaderBudget resolves the header cascade for every file with
+// headers.Resolve. viewer-response.js drops the headers past headers.Budget,
+// so it returns an error for each file whose headers go over it on every
+// request, and a warning for each file whose headers only go over it when
+// request tokens like {query} take their longest values.
+func CheckHeaderBudget(files []string, entries []kvs.Entry) (HeaderUsage, []kvs.ValidationError, []kvs.ValidationError) {
+	store := entryMap(entries)
+
+	var usage HeaderUsage
+	var errs, warnings []kvs.ValidationError
+	for _, f := range files {
+		r, err := headers.Resolve(f, store)
+		if err != nil {
+			errs = append(errs, kvs.ValidationError{Key: f, Message: err.Error()})
+			continue
+		}
+		switch {
+		case r.AlwaysTruncated:
+			errs = append(errs, kvs.ValidationError{
+				Key:     f,
+				Message: fmt.Sprintf("headers from %s go over the %d-byte header budget and would be truncated", strings.Join(r.Matched, ", "), headers.Budget),
+			})
+		case r.Truncated:
+			warnings = append(warnings, kvs.ValidationError{
+				Key:     f,
+				Message: fmt.Sprintf("headers from %s go over the %d-byte header budget, and would be truncated, when request tokens take their longest values", strings.Join(r.Matched, ", "), headers.Budget),
+			})
+		}
+		if r.Size > usage.Size {
+			usage = HeaderUsage{Path: f, Size: r.Size}
+		}
+	}
+	return usage, errs, warnings
+}
+
+// CompileHeaders returns the header entries for compiled mode (see
+// headers.Compile), sorted by key.
+func CompileHeaders(files []string, entries []kvs.Entry) ([]kvs.Entry, error) {
+	compiled, err := headers.Compile(files, entryMap(entries))
+	if err != nil {
+		return nil, fmt.Errorf("compiling headers: %w", err)
+	}
+	return sortedEntries(compiled), nil
+}
+
+// ShareHeaders returns the header entries with repeated header sets stored
+// once (see headers.Share), sorted by key.
+func ShareHeaders(entries []kvs.Entry) []kvs.Entry {
+	return sortedEntries(headers.Share(entryMap(entries)))
+}
+
+func entryMap(entries []kvs.Entry) map[string]string {
+	m := make(map[string]string, len(entries))
+	for _, e := range entries {
+		m[e.Key] = e.Value
+	}
+	return m
+}
+
+func sortedEntries(m map[string]string) []kvs.Entry {
+	entries := make([]kvs.Entry, 0, len(m))
+	for key, value := range m {
+		entries = append(entries, kvs.Entry{Key: key, Value: value})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+	return entries
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// NoindexValue is the X-Robots-Tag ApplyNoindex sets on every response.
+const NoindexValue = "noindex, nofollow"
+
+// ApplyNoindex returns the header entries with X-Robots-Tag set to
+// NoindexValue on "/" and every other rule for X-Robots-Tag removed, so no
+// page can override it. Entries left with no headers are dropped.
+func ApplyNoindex(entries []kvs.Entry) ([]kvs.Entry, error) {
+	store := entryMap(entries)
+	for key, value := range store {
+		fields, err := headers.Decode(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		var kept []headers.Field
+		for _, f := range fields {
+			if f.Name != "x-robots-tag" {
+				kept = append(kept, f)
+			}
+		}
+		if len(kept) == len(fields) {
+			continue
+		}
+		if len(kept) == 0 {
+			delete(store, key)
+			continue
+		}
+		store[key] = headers.Encode(headers.Rules(kept))
+	}
+
+	root := map[string]string{}
+	if value, ok := store["/"]; ok {
+		fields, _ := headers.Decode(value) // Decoded above
+		root = headers.Rules(fields)
+	}
+	root["x-robots-tag"] = NoindexValue
+	store["/"] = headers.Encode(root)
+	return sortedEntries(store), nil
+}
 
-	return entries, nil
+// HasScopedGlobs reports whether the header entries include directory-scoped
+// extension keys (see headers.HasScopedGlobs).
+func HasScopedGlobs(entries []kvs.Entry) bool {
+	return headers.HasScopedGlobs(entryMap(entries))
 }
@@ -3,8 +3,12 @@ package hugo
 import (
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
+
+	"github.com/mrled/hedgerules/hedgerules/internal/headers"
+	"github.com/mrled/hedgerules/hedgerules/internal/kvs"
 )
 
 func TestParseHeaders(t *testing.T) {
@@ -20,7 +24,7 @@ func TestParseHeaders(t *testing.T) {
 }`
 	os.WriteFile(filepath.Join(dir, "_hedge_headers.json"), []byte(content), 0644)
 
-	entries, err := ParseHeaders(dir)
+	entries, _, err := ParseHeaders(dir, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -39,10 +43,10 @@ func TestParseHeaders(t *testing.T) {
 	if !ok {
 		t.Fatal("missing / entry")
 	}
-	if !strings.Contains(root, "X-Frame-Options: DENY") {
+	if !strings.Contains(root, "x-frame-options:DENY") {
 		t.Errorf("root missing X-Frame-Options header, got: %s", root)
 	}
-	if !strings.Contains(root, "X-Content-Type-Options: nosniff") {
+	if !strings.Contains(root, "x-content-type-options:nosniff") {
 		t.Errorf("root missing X-Content-Type-Options header, got: %s", root)
 	}
 
@@ -51,14 +55,335 @@ func TestParseHeaders(t *testing.T) {
 	if !ok {
 		t.Fatal("missing /blog/my-post/ entry")
 	}
-	if blog != "Cache-Control: max-age=3600" {
-		t.Errorf("blog entry: expected 'Cache-Control: max-age=3600', got '%s'", blog)
+	if blog != "~1\ncache-control:max-age=3600" {
+		t.Errorf("blog entry: expected '~1\\ncache-control:max-age=3600', got '%s'", blog)
+	}
+}
+
+func TestParseHeaders_Deterministic(t *testing.T) {
+	dir := t.TempDir()
+	content := `{
+  "/": {"X-Frame-Options": "DENY", "X-Content-Type-Options": "nosniff", "Referrer-Policy": "no-referrer"},
+  "/blog/": {"Cache-Control": "max-age=3600", "X-Section": "blog"}
+}`
+	os.WriteFile(filepath.Join(dir, "_hedge_headers.json"), []byte(content), 0644)
+
+	first, _, err := ParseHeaders(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	existing := make(map[string]string)
+	for _, e := range first {
+		existing[e.Key] = e.Value
+	}
+
+	// Map iteration order varies between runs; re-parsing must not.
+	for i := 0; i < 20; i++ {
+		again, _, err := ParseHeaders(dir, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plan := kvs.ComputeSyncPlan(&kvs.Data{Entries: again}, existing)
+		if len(plan.Puts) != 0 || len(plan.Deletes) != 0 {
+			t.Fatalf("re-parse %d: expected empty plan, got %d puts, %d deletes", i, len(plan.Puts), len(plan.Deletes))
+		}
+	}
+	if first[0].Key != "/" || first[1].Key != "/blog/" {
+		t.Errorf("expected entries sorted by path, got %s, %s", first[0].Key, first[1].Key)
+	}
+}
+
+func TestParseHeaders_Operators(t *testing.T) {
+	dir := t.TempDir()
+	content := `{
+  "/": {"!Server": "", "!X-Amz-Server-Side-Encryption": "", "Vary": "Accept-Encoding"},
+  "/blog/": {"+Vary": "Origin", "+Link": "</main.css>; rel=preload; as=style"}
+}`
+	os.WriteFile(filepath.Join(dir, "_hedge_headers.json"), []byte(content), 0644)
+
+	entries, _, err := ParseHeaders(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := make(map[string]string)
+	for _, e := range entries {
+		result[e.Key] = e.Value
+	}
+
+	if want := "~1\n!server:\nvary:Accept-Encoding\n!x-amz-server-side-encryption:"; result["/"] != want {
+		t.Errorf("root: expected %q, got %q", want, result["/"])
+	}
+	if want := "~1\n+link:</main.css>; rel=preload; as=style\n+vary:Origin"; result["/blog/"] != want {
+		t.Errorf("blog: expected %q, got %q", want, result["/blog/"])
+	}
+}
+
+func TestParseHeaders_Globs(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "docs", "guide"), 0755)
+	os.WriteFile(filepath.Join(dir, "docs", "guide", "manual.pdf"), []byte("%PDF"), 0644)
+	os.WriteFile(filepath.Join(dir, "docs", "index.html"), []byte("<html>"), 0644)
+	content := `{
+  "/docs/**/*.pdf": {"X-Robots-Tag": "noindex"},
+  "/assets/**": {"Cache-Control": "max-age=31536000"}
+}`
+	os.WriteFile(filepath.Join(dir, "_hedge_headers.json"), []byte(content), 0644)
+
+	entries, _, err := ParseHeaders(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []kvs.Entry{
+		{Key: "/assets/", Value: "~1\ncache-control:max-age=31536000"},
+		{Key: "/docs/guide/*.pdf", Value: "~1\nx-robots-tag:noindex"},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("expected %v, got %v", want, entries)
+	}
+}
+
+func TestParseHeaders_InvalidGlob(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "_hedge_headers.json"), []byte(`{"/docs/*/index.html": {"A": "b"}}`), 0644)
+
+	if _, _, err := ParseHeaders(dir, nil); err == nil {
+		t.Error("expected error for unsupported glob")
+	}
+}
+
+func TestCheckLookups(t *testing.T) {
+	files := []string{
+		"/index.html",
+		"/a/b/c/d/e/f/g/page.html",
+		"/a/b/c/d/e/f/g/h/page.html",
+	}
+	errs := CheckLookups(files, nil)
+	if len(errs) != 1 || errs[0].Key != "/a/b/c/d/e/f/g/h/page.html" {
+		t.Errorf("expected one warning for the deepest path, got %v", errs)
+	}
+
+	// Following a reference costs a lookup too
+	entries := []kvs.Entry{{Key: "/a/", Value: headers.Ref("#0123456789abcdef")}}
+	errs = CheckLookups(files[:2], entries)
+	if len(errs) != 1 || errs[0].Key != "/a/b/c/d/e/f/g/page.html" {
+		t.Errorf("expected one warning for the referencing path, got %v", errs)
+	}
+
+	// And the directory-scoped extension lookup, once there are such keys
+	entries = []kvs.Entry{{Key: "/docs/*.pdf", Value: headers.Encode(map[string]string{"X-A": "b"})}}
+	errs = CheckLookups(files[:2], entries)
+	if len(errs) != 1 || errs[0].Key != "/a/b/c/d/e/f/g/page.html" {
+		t.Errorf("expected one warning with scoped globs, got %v", errs)
+	}
+}
+
+func TestHasScopedGlobs(t *testing.T) {
+	if HasScopedGlobs([]kvs.Entry{{Key: "*.pdf"}, {Key: "/docs/"}, {Key: "/a.html"}}) {
+		t.Error("expected no scoped globs")
+	}
+	if !HasScopedGlobs([]kvs.Entry{{Key: "/*.pdf"}}) || !HasScopedGlobs([]kvs.Entry{{Key: "/docs/*.pdf"}}) {
+		t.Error("expected scoped globs")
+	}
+}
+
+func TestShareHeaders(t *testing.T) {
+	section := headers.Encode(map[string]string{"X-Section": "blog", "Cache-Control": "public, max-age=3600"})
+	entries := []kvs.Entry{
+		{Key: "/", Value: headers.Encode(map[string]string{"X-Frame-Options": "DENY"})},
+		{Key: "/blog/a/", Value: section},
+		{Key: "/blog/b/", Value: section},
+		{Key: "/blog/c/", Value: section},
+	}
+	shared := ShareHeaders(entries)
+	result := make(map[string]string)
+	for _, e := range shared {
+		result[e.Key] = e.Value
+	}
+
+	key := headers.SetKey(section)
+	if result[key] != section {
+		t.Errorf("expected shared set under %s, got %v", key, result)
+	}
+	for _, path := range []string{"/blog/a/", "/blog/b/", "/blog/c/"} {
+		if result[path] != headers.Ref(key) {
+			t.Errorf("%s: expected reference, got %q", path, result[path])
+		}
+	}
+	if result["/"] != entries[0].Value {
+		t.Errorf("expected unique set to stay inline, got %q", result["/"])
+	}
+	if before, after := (&kvs.Data{Entries: entries}).Stats(), (&kvs.Data{Entries: shared}).Stats(); after.TotalBytes >= before.TotalBytes {
+		t.Errorf("expected sharing to save bytes, got %d -> %d", before.TotalBytes, after.TotalBytes)
+	}
+}
+
+func TestCheckHeaderBudget(t *testing.T) {
+	entries := []kvs.Entry{
+		{Key: "/", Value: headers.Encode(map[string]string{"X-Frame-Options": "DENY"})},
+		{Key: "/big/", Value: headers.Encode(map[string]string{"X-A": strings.Repeat("a", 1000)})},
+		{Key: "/big/page/", Value: headers.Encode(map[string]string{"X-B": "{query}{query}{query}"})},
+		{Key: "/huge/", Value: headers.Encode(map[string]string{"X-C": strings.Repeat("c", 2100)})},
+		{Key: "/huge/page/", Value: headers.Encode(map[string]string{"X-D": strings.Repeat("d", 2100)})},
+	}
+	files := []string{"/index.html", "/big/index.html", "/big/page/index.html", "/huge/page/index.html"}
+
+	usage, errs, warnings := CheckHeaderBudget(files, entries)
+	// Long query strings may push /big/page/ over the budget, but need not
+	if len(warnings) != 1 || warnings[0].Key != "/big/page/index.html" {
+		t.Errorf("expected one warning for /big/page/index.html, got %v", warnings)
+	}
+	// /huge/page/ goes over it on every request
+	if len(errs) != 1 || errs[0].Key != "/huge/page/index.html" {
+		t.Errorf("expected one error for /huge/page/index.html, got %v", errs)
+	}
+	if usage.Path != "/huge/page/index.html" {
+		t.Errorf("expected largest header set at /huge/page/index.html, got %s (%d bytes)", usage.Path, usage.Size)
+	}
+}
+
+func TestCompileHeaders(t *testing.T) {
+	entries := []kvs.Entry{
+		{Key: "/", Value: headers.Encode(map[string]string{"X-Frame-Options": "DENY"})},
+	}
+	compiled, err := CompileHeaders([]string{"/index.html", "/about/index.html"}, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// One shared set, plus a reference for "/" and each file
+	if len(compiled) != 4 {
+		t.Fatalf("expected 4 entries, got %v", compiled)
+	}
+	if compiled[0].Key[0] != '#' || compiled[1].Key != "/" {
+		t.Errorf("expected entries sorted by key, got %v", compiled)
+	}
+	for _, e := range compiled[1:] {
+		if e.Value != headers.Ref(compiled[0].Key) {
+			t.Errorf("%s: expected reference to %s, got %q", e.Key, compiled[0].Key, e.Value)
+		}
+	}
+}
+
+func TestParseHeaders_Lint(t *testing.T) {
+	dir := t.TempDir()
+	content := `{
+  "/": {"X-Frame-Options": "DENY"},
+  "/blog/": {"Cache-Control": "max-age=60", "cache-control": "max-age=3600", "Bad Name": "x"}
+}`
+	os.WriteFile(filepath.Join(dir, "_hedge_headers.json"), []byte(content), 0644)
+
+	entries, lintErrors, err := ParseHeaders(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("expected entries despite lint errors, got %d", len(entries))
+	}
+	if len(lintErrors) != 2 {
+		t.Fatalf("expected 2 lint errors, got %v", lintErrors)
+	}
+	for _, e := range lintErrors {
+		if e.Key != "/blog/" {
+			t.Errorf("expected error for /blog/, got %v", e)
+		}
+	}
+}
+
+func TestParseHeaders_Base(t *testing.T) {
+	dir := t.TempDir()
+	content := `{"/": {"x-frame-options": "SAMEORIGIN", "X-Custom": "1"}}`
+	os.WriteFile(filepath.Join(dir, "_hedge_headers.json"), []byte(content), 0644)
+	base := map[string]map[string]string{"/": {"X-Frame-Options": "DENY", "X-Content-Type-Options": "nosniff"}}
+
+	entries, _, err := ParseHeaders(dir, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "~1\nx-content-type-options:nosniff\nx-custom:1\nx-frame-options:SAMEORIGIN"
+	if len(entries) != 1 || entries[0].Value != want {
+		t.Errorf("expected file rules over base, got %v", entries)
+	}
+
+	// Base rules apply without a headers file too
+	entries, _, err = ParseHeaders(t.TempDir(), base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Key != "/" {
+		t.Errorf("expected base entry for /, got %v", entries)
+	}
+}
+
+func TestParseHeaders_CacheRules(t *testing.T) {
+	dir := t.TempDir()
+	content := `{"*.css": {"Cache-Control": "no-store"}, "/js/**": {"Cache-Control": "no-cache"}}`
+	os.WriteFile(filepath.Join(dir, "_hedge_headers.json"), []byte(content), 0644)
+	files := []string{"/css/main.3f2a9c1d.css", "/js/app.a1b2c3d4.js", "/img/logo.4e5d6f70.png"}
+	base := CacheConfig{Fingerprinted: true}.Rules(files)
+
+	entries, _, err := ParseHeaders(dir, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := entryMap(entries)
+	want := map[string]string{
+		"/css/main.3f2a9c1d.css": "no-store",
+		"/js/app.a1b2c3d4.js":    "no-cache",
+		"/img/logo.4e5d6f70.png": DefaultImmutableCacheControl,
+	}
+	for f, cc := range want {
+		r, err := headers.Resolve(f, store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := r.Headers["cache-control"]; got == nil || *got != cc {
+			t.Errorf("%s: expected Cache-Control %q, got %v", f, cc, got)
+		}
+	}
+}
+
+func TestPolicyWarnings(t *testing.T) {
+	entries := []kvs.Entry{
+		{Key: "/", Value: headers.Encode(map[string]string{"Strict-Transport-Security": "max-age=60"})},
+		{Key: "/ok/", Value: headers.Encode(map[string]string{"X-Frame-Options": "DENY"})},
+	}
+	warnings := PolicyWarnings(entries)
+	if len(warnings) != 1 || warnings[0].Key != "/" {
+		t.Errorf("expected one warning for /, got %v", warnings)
+	}
+}
+
+func TestApplyNoindex(t *testing.T) {
+	entries := []kvs.Entry{
+		{Key: "/", Value: headers.Encode(map[string]string{"X-Frame-Options": "DENY"})},
+		{Key: "/blog/", Value: headers.Encode(map[string]string{"X-Robots-Tag": "all", "X-Section": "blog"})},
+		{Key: "/open/", Value: headers.Encode(map[string]string{"!X-Robots-Tag": ""})},
+		{Key: "*.pdf", Value: headers.Encode(map[string]string{"+X-Robots-Tag": "noarchive"})},
+	}
+	got, err := ApplyNoindex(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []kvs.Entry{
+		{Key: "/", Value: "~1\nx-frame-options:DENY\nx-robots-tag:noindex, nofollow"},
+		{Key: "/blog/", Value: "~1\nx-section:blog"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	// A root entry is created if there was none
+	got, err = ApplyNoindex(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Value != "~1\nx-robots-tag:noindex, nofollow" {
+		t.Errorf("expected a root entry, got %v", got)
 	}
 }
 
 func TestParseHeaders_NoFile(t *testing.T) {
 	dir := t.TempDir()
-	entries, err := ParseHeaders(dir)
+	entries, _, err := ParseHeaders(dir, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -71,7 +396,7 @@ func TestParseHeaders_InvalidJSON(t *testing.T) {
 	dir := t.TempDir()
 	os.WriteFile(filepath.Join(dir, "_hedge_headers.json"), []byte("{invalid"), 0644)
 
-	_, err := ParseHeaders(dir)
+	_, _, err := ParseHeaders(dir, nil)
 	if err == nil {
 		t.Error("expected error for invalid JSON")
 	}
@@ -81,7 +406,7 @@ func TestParseHeaders_EmptyJSON(t *testing.T) {
 	dir := t.TempDir()
 	os.WriteFile(filepath.Join(dir, "_hedge_headers.json"), []byte("{}"), 0644)
 
-	entries, err := ParseHeaders(dir)
+	entries, _, err := ParseHeaders(dir, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
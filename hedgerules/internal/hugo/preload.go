@@ -0,0 +1,226 @@
+package hugo
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/mrled/hedgerules/hedgerules/internal/headers"
+	"github.com/mrled/hedgerules/hedgerules/internal/kvs"
+)
+
+// DefaultPreloadBudget is the longest Link header, in bytes, PreloadConfig
+// generates for a page when Budget is unset.
+const DefaultPreloadBudget = 512
+
+// PreloadConfig is the [preload] table of hedgerules.toml.
+type PreloadConfig struct {
+	// Enabled turns on Link preload headers generated from each page's HTML.
+	Enabled bool `toml:"enabled"`
+	// Budget overrides DefaultPreloadBudget.
+	Budget int `toml:"budget"`
+	// Modules adds rel=modulepreload links for module scripts.
+	Modules bool `toml:"modules"`
+}
+
+var (
+	linkTagPattern   = regexp.MustCompile(`(?is)<link\b[^>]*>`)
+	scriptTagPattern = regexp.MustCompile(`(?is)<script\b[^>]*>`)
+	attrPattern      = regexp.MustCompile(`(?s)([a-zA-Z-]+)\s*=\s*("[^"]*"|'[^']*'|[^\s"'>]+)`)
+	fontURLPattern   = regexp.MustCompile(`url\(\s*['"]?([^'")?#]+\.woff2)(?:[?#][^'")]*)?['"]?\s*\)`)
+)
+
+// ScanPreloads walks outputDir and returns the Link header values for every
+// HTML file that references local stylesheets, keyed by the file's URL path.
+// Each stylesheet gets a rel=preload link, followed by the WOFF2 fonts it
+// uses, and, with Modules, module scripts get rel=modulepreload links. Only
+// same-origin references (absolute paths or relative URLs) are considered, and
+// their query strings and fragments are dropped, since a preload only helps a
+// request for the same URL and the site serves one file for all of them.
+func (c PreloadConfig) ScanPreloads(outputDir string) (map[string][]string, error) {
+	fontsByCSS := make(map[string][]string)
+
+	pages := make(map[string][]string)
+	err := filepath.WalkDir(outputDir, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.EqualFold(filepath.Ext(p), ".html") {
+			return nil
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(outputDir, p)
+		if err != nil {
+			return err
+		}
+		page := "/" + filepath.ToSlash(rel)
+		html := string(data)
+
+		var links []string
+		for _, tag := range linkTagPattern.FindAllString(html, -1) {
+			attrs := parseAttrs(tag)
+			href, ok := localURL(page, attrs["href"])
+			if !ok || !hasToken(attrs["rel"], "stylesheet") || hasToken(attrs["rel"], "alternate") {
+				continue
+			}
+			css := stripQuery(href)
+			links = appendUnique(links, fmt.Sprintf("<%s>; rel=preload; as=style", css))
+
+			fonts, ok := fontsByCSS[css]
+			if !ok {
+				fonts = scanFonts(outputDir, css)
+				fontsByCSS[css] = fonts
+			}
+			for _, font := range fonts {
+				links = appendUnique(links, fmt.Sprintf(`<%s>; rel=preload; as=font; type="font/woff2"; crossorigin`, font))
+			}
+		}
+		if c.Modules {
+			for _, tag := range scriptTagPattern.FindAllString(html, -1) {
+				attrs := parseAttrs(tag)
+				src, ok := localURL(page, attrs["src"])
+				if ok && strings.EqualFold(attrs["type"], "module") {
+					links = appendUnique(links, fmt.Sprintf("<%s>; rel=modulepreload", stripQuery(src)))
+				}
+			}
+		}
+		if len(links) > 0 {
+			pages[page] = links
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("scanning HTML for preloads: %w", err)
+	}
+	return pages, nil
+}
+
+// AddPreloadLinks appends each page's Link header values (see ScanPreloads)
+// to the header entry under the page's own path, after any Link headers the
+// cascade gives it. A link is left out if it would make the preloads longer
+// than the budget, the page's entry larger than kvs.MaxEntryBytes, or the
+// page's headers longer than headers.Budget when request tokens take their
+// longest values; each page that loses links gets a warning naming them.
+func (c PreloadConfig) AddPreloadLinks(entries []kvs.Entry, links map[string][]string) ([]kvs.Entry, []kvs.ValidationError, []kvs.ValidationError) {
+	budget := c.Budget
+	if budget == 0 {
+		budget = DefaultPreloadBudget
+	}
+	store := entryMap(entries)
+	var errs, warnings []kvs.ValidationError
+	for _, page := range sortedKeys(links) {
+		own := map[string]string{}
+		if value, ok := store[page]; ok {
+			fields, err := headers.Decode(value)
+			if err != nil {
+				errs = append(errs, kvs.ValidationError{Key: page, Message: err.Error()})
+				continue
+			}
+			own = headers.Rules(fields)
+		}
+		original, hasOriginal := store[page]
+
+		value := ""
+		var dropped []string
+		for _, link := range links[page] {
+			next := link
+			if value != "" {
+				next = value + ", " + link
+			}
+			if len(next) > budget || !preloadFits(store, page, headers.Merge(own, map[string]string{"+link": next})) {
+				dropped = append(dropped, strings.TrimPrefix(link[:strings.Index(link, ">")], "<"))
+				continue
+			}
+			value = next
+		}
+
+		switch {
+		case value != "":
+			store[page] = headers.Encode(headers.Merge(own, map[string]string{"+link": value}))
+		case hasOriginal:
+			store[page] = original
+		default:
+			delete(store, page)
+		}
+		if len(dropped) > 0 {
+			warnings = append(warnings, kvs.ValidationError{
+				Key:     page,
+				Message: fmt.Sprintf("left out preload links that would go over the preload budget or the header size limits: %s", strings.Join(dropped, ", ")),
+			})
+		}
+	}
+	return sortedEntries(store), errs, warnings
+}
+
+// preloadFits stores rules as page's entry and reports whether the entry fits
+// in kvs.MaxEntryBytes and headers.CheckValue, and the page's cascade fits in
+// headers.Budget with request tokens at their longest.
+func preloadFits(store map[string]string, page string, rules map[string]string) bool {
+	value := headers.Encode(rules)
+	if len(page)+len(value) > kvs.MaxEntryBytes || headers.CheckValue(value) != nil {
+		return false
+	}
+	store[page] = value
+	r, err := headers.Resolve(page, store)
+	return err == nil && !r.Truncated
+}
+
+// scanFonts returns the WOFF2 fonts referenced by a stylesheet in outputDir,
+// as URL paths. A stylesheet that cannot be read has none.
+func scanFonts(outputDir, css string) []string {
+	data, err := os.ReadFile(filepath.Join(outputDir, filepath.FromSlash(css)))
+	if err != nil {
+		return nil
+	}
+	var fonts []string
+	for _, m := range fontURLPattern.FindAllStringSubmatch(string(data), -1) {
+		if font, ok := localURL(css, m[1]); ok {
+			fonts = appendUnique(fonts, font)
+		}
+	}
+	return fonts
+}
+
+// localURL resolves a reference from the file at base to a URL path, and
+// reports false for empty references and ones to another origin.
+func localURL(base, ref string) (string, bool) {
+	if ref == "" || strings.HasPrefix(ref, "//") || strings.HasPrefix(ref, "data:") || strings.Contains(stripQuery(ref), "://") {
+		return "", false
+	}
+	if strings.HasPrefix(ref, "/") {
+		return ref, true
+	}
+	return path.Join(path.Dir(base), ref), true
+}
+
+func stripQuery(u string) string {
+	if i := strings.IndexAny(u, "?#"); i != -1 {
+		return u[:i]
+	}
+	return u
+}
+
+// parseAttrs returns the attributes of an HTML tag, with names lowercased.
+func parseAttrs(tag string) map[string]string {
+	attrs := make(map[string]string)
+	for _, m := range attrPattern.FindAllStringSubmatch(tag, -1) {
+		attrs[strings.ToLower(m[1])] = strings.Trim(m[2], `"'`)
+	}
+	return attrs
+}
+
+// hasToken reports whether a space-separated attribute like rel has token.
+func hasToken(value, token string) bool {
+	for _, t := range strings.Fields(value) {
+		if strings.EqualFold(t, token) {
+			return true
+		}
+	}
+	return false
+}
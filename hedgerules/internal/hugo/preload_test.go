@@ -0,0 +1,106 @@
+package hugo
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mrled/hedgerules/hedgerules/internal/headers"
+	"github.com/mrled/hedgerules/hedgerules/internal/kvs"
+)
+
+func TestScanPreloads(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "css"), 0755)
+	os.MkdirAll(filepath.Join(dir, "blog"), 0755)
+	os.WriteFile(filepath.Join(dir, "css", "main.css"), []byte(`@font-face { src: url("../fonts/inter.woff2") format("woff2"), url(../fonts/inter.woff); }`), 0644)
+	page := `<html><head>
+<link rel="stylesheet" href="/css/main.css?v=1">
+<link rel="alternate stylesheet" href="/css/alt.css">
+<link rel=stylesheet href="https://cdn.example.com/x.css">
+<link rel="icon" href="/favicon.ico">
+<script type="module" src="app.js"></script>
+<script src="/legacy.js"></script>
+</head></html>`
+	os.WriteFile(filepath.Join(dir, "blog", "index.html"), []byte(page), 0644)
+	os.WriteFile(filepath.Join(dir, "index.html"), []byte("<html></html>"), 0644)
+
+	preloads, err := PreloadConfig{Enabled: true, Modules: true}.ScanPreloads(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"</css/main.css>; rel=preload; as=style",
+		`</fonts/inter.woff2>; rel=preload; as=font; type="font/woff2"; crossorigin`,
+		"</blog/app.js>; rel=modulepreload",
+	}
+	if len(preloads) != 1 || !reflect.DeepEqual(preloads["/blog/index.html"], want) {
+		t.Errorf("expected %q for /blog/index.html, got %v", want, preloads)
+	}
+}
+
+func TestAddPreloadLinks(t *testing.T) {
+	entries := []kvs.Entry{
+		{Key: "/blog/index.html", Value: headers.Encode(map[string]string{"+Link": "</a.css>; rel=preload"})},
+	}
+	links := map[string][]string{
+		"/blog/index.html":  {"</b.css>; rel=preload; as=style"},
+		"/about/index.html": {"</c.css>; rel=preload; as=style"},
+	}
+	got, errs, warnings := PreloadConfig{}.AddPreloadLinks(entries, links)
+	if len(errs) != 0 || len(warnings) != 0 {
+		t.Fatal(errs, warnings)
+	}
+	result := entryMap(got)
+	if want := "~1\n+link:</a.css>; rel=preload, </b.css>; rel=preload; as=style"; result["/blog/index.html"] != want {
+		t.Errorf("blog: expected %q, got %q", want, result["/blog/index.html"])
+	}
+	if !strings.HasSuffix(result["/about/index.html"], "+link:</c.css>; rel=preload; as=style") {
+		t.Errorf("about: unexpected %q", result["/about/index.html"])
+	}
+}
+
+func TestAddPreloadLinks_Limits(t *testing.T) {
+	links := map[string][]string{
+		"/index.html": {
+			"</a.css>; rel=preload; as=style",
+			"</" + strings.Repeat("b", 80) + ".css>; rel=preload; as=style",
+			"</c.css>; rel=preload; as=style",
+		},
+	}
+
+	// Links past the preload budget are left out, and later ones that fit kept
+	got, _, warnings := PreloadConfig{Budget: 70}.AddPreloadLinks(nil, links)
+	if want := "~1\n+link:</a.css>; rel=preload; as=style, </c.css>; rel=preload; as=style"; entryMap(got)["/index.html"] != want {
+		t.Errorf("expected %q, got %q", want, entryMap(got)["/index.html"])
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0].Message, "/"+strings.Repeat("b", 80)+".css") {
+		t.Errorf("expected a warning naming the dropped link, got %v", warnings)
+	}
+
+	// So are links that would push the page's cascade over headers.Budget
+	entries := []kvs.Entry{
+		{Key: "/", Value: headers.Encode(map[string]string{"X-Big": strings.Repeat("x", headers.Budget-60)})},
+	}
+	got, errs, warnings := PreloadConfig{Budget: 1000}.AddPreloadLinks(entries, links)
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	if want := "~1\n+link:</a.css>; rel=preload; as=style"; entryMap(got)["/index.html"] != want {
+		t.Errorf("expected %q, got %q", want, entryMap(got)["/index.html"])
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0].Message, "/c.css") {
+		t.Errorf("expected a warning naming the dropped links, got %v", warnings)
+	}
+	if r, _ := headers.Resolve("/index.html", entryMap(got)); r.Truncated {
+		t.Errorf("expected the preloads to fit the header budget, got %+v", r)
+	}
+
+	// A page none of whose links fit gets no entry
+	got, _, _ = PreloadConfig{Budget: 10}.AddPreloadLinks(nil, links)
+	if len(got) != 0 {
+		t.Errorf("expected no entries, got %v", got)
+	}
+}
@@ -0,0 +1,47 @@
+package kvs
+
+import "fmt"
+
+// DefaultMaxDeletePercent is the largest share of a KVS's existing keys a
+// sync may delete when DeleteLimit.Percent is unset.
+const DefaultMaxDeletePercent = 50
+
+// DeleteLimit bounds how many existing keys a sync plan may delete, to catch
+// a deploy of an empty or wrong build before it empties a KVS.
+type DeleteLimit struct {
+	// Percent is the largest share of existing keys a plan may delete;
+	// 0 means DefaultMaxDeletePercent, and 100 or more turns it off.
+	Percent float64
+	// Count, if set, is the most keys a plan may delete.
+	Count int
+}
+
+// MassDeleteError reports a plan that deletes more keys than a DeleteLimit
+// allows.
+type MassDeleteError struct {
+	Deletes  int
+	Existing int
+	Limit    string
+}
+
+func (e *MassDeleteError) Error() string {
+	return fmt.Sprintf("plan deletes %d of %d existing keys, more than the limit of %s",
+		e.Deletes, e.Existing, e.Limit)
+}
+
+// Check returns a *MassDeleteError if plan deletes more of the existing keys
+// in a KVS than l allows.
+func (l DeleteLimit) Check(plan *SyncPlan, existing int) error {
+	_, deletes := plan.Size()
+	if l.Count > 0 && deletes > l.Count {
+		return &MassDeleteError{Deletes: deletes, Existing: existing, Limit: fmt.Sprintf("%d keys", l.Count)}
+	}
+	percent := l.Percent
+	if percent == 0 {
+		percent = DefaultMaxDeletePercent
+	}
+	if existing > 0 && float64(deletes)*100 > percent*float64(existing) {
+		return &MassDeleteError{Deletes: deletes, Existing: existing, Limit: fmt.Sprintf("%g%%", percent)}
+	}
+	return nil
+}
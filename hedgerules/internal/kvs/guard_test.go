@@ -0,0 +1,51 @@
+package kvs
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func deletePlan(n int) *SyncPlan {
+	plan := &SyncPlan{}
+	for i := 0; i < n; i++ {
+		plan.Deletes = append(plan.Deletes, fmt.Sprintf("/page%d", i))
+	}
+	return plan
+}
+
+func TestDeleteLimit_Check(t *testing.T) {
+	tests := []struct {
+		name     string
+		limit    DeleteLimit
+		deletes  int
+		existing int
+		wantErr  bool
+	}{
+		{"default allows half", DeleteLimit{}, 50, 100, false},
+		{"default refuses more than half", DeleteLimit{}, 51, 100, true},
+		{"emptying a store", DeleteLimit{}, 100, 100, true},
+		{"percent", DeleteLimit{Percent: 10}, 11, 100, true},
+		{"percent off", DeleteLimit{Percent: 100}, 100, 100, false},
+		{"count", DeleteLimit{Percent: 100, Count: 5}, 6, 100, true},
+		{"within count", DeleteLimit{Count: 5}, 5, 100, false},
+		{"empty store", DeleteLimit{}, 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.limit.Check(deletePlan(tt.deletes), tt.existing)
+			var massDelete *MassDeleteError
+			if got := errors.As(err, &massDelete); got != tt.wantErr {
+				t.Fatalf("Check() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMassDeleteError(t *testing.T) {
+	err := DeleteLimit{}.Check(deletePlan(90), 100)
+	want := "plan deletes 90 of 100 existing keys, more than the limit of 50%"
+	if err == nil || err.Error() != want {
+		t.Errorf("got %v, want %q", err, want)
+	}
+}
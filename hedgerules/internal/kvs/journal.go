@@ -0,0 +1,171 @@
+package kvs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Journal records the progress of a sync in local files, so a sync that
+// stops partway can resume without listing the KVS again. Operations are
+// counted in the order Sync applies them: puts, then deletes, then those of
+// the plan's Finally.
+//
+// The plan is written once, to the journal's path. Each checkpoint appends
+// a line to a progress file beside it, so checkpointing a large plan doesn't
+// rewrite it batch after batch.
+type Journal struct {
+	KVSARN   string   `json:"kvsArn"`
+	DataHash string   `json:"dataHash"` // Hash of the data the plan syncs to
+	Plan     SyncPlan `json:"plan"`
+	Done     int      `json:"done"` // Operations of Plan applied
+	ETag     string   `json:"etag"` // ETag of the KVS after them
+
+	path string
+}
+
+// journalProgress is a line of a journal's progress file.
+type journalProgress struct {
+	Done int    `json:"done"`
+	ETag string `json:"etag"`
+}
+
+// NewJournal starts a journal at path for applying plan to the KVS at arn,
+// whose ETag is etag, to bring it in line with data. The progress of any
+// earlier journal at path is removed first, so it is never read against the
+// new plan.
+func NewJournal(path, arn string, data *Data, plan *SyncPlan, etag string) (*Journal, error) {
+	j := &Journal{KVSARN: arn, DataHash: data.Hash(), Plan: *plan, ETag: etag, path: path}
+	if err := os.Remove(progressPath(path)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("removing sync journal progress: %w", err)
+	}
+	if err := j.write(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// LoadJournal reads the journal at path and its latest checkpoint, or
+// returns nil if there is none. A checkpoint cut off partway through
+// writing it is ignored.
+func LoadJournal(path string) (*Journal, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading sync journal: %w", err)
+	}
+	j := &Journal{path: path}
+	if err := json.Unmarshal(b, j); err != nil {
+		return nil, fmt.Errorf("reading sync journal %s: %w", path, err)
+	}
+
+	b, err = os.ReadFile(progressPath(path))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("reading sync journal progress: %w", err)
+	}
+	for _, line := range bytes.Split(b, []byte("\n")) {
+		var p journalProgress
+		if json.Unmarshal(line, &p) != nil {
+			continue
+		}
+		j.Done, j.ETag = p.Done, p.ETag
+	}
+	return j, nil
+}
+
+// Matches reports whether the journal is for syncing data to the KVS at arn.
+func (j *Journal) Matches(arn string, data *Data) bool {
+	return j.KVSARN == arn && j.DataHash == data.Hash()
+}
+
+// Remaining returns the operations of the plan not yet applied.
+func (j *Journal) Remaining() *SyncPlan {
+	return j.Plan.after(j.Done)
+}
+
+// Remove deletes the journal files, once its plan is applied.
+func (j *Journal) Remove() error {
+	for _, path := range []string{j.path, progressPath(j.path)} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("removing sync journal: %w", err)
+		}
+	}
+	return nil
+}
+
+// checkpoint records that done operations of the plan are applied, leaving
+// the KVS at etag, by appending a line to the progress file.
+func (j *Journal) checkpoint(done int, etag string) error {
+	j.Done = done
+	j.ETag = etag
+	b, err := json.Marshal(journalProgress{Done: done, ETag: etag})
+	if err != nil {
+		return fmt.Errorf("encoding sync journal progress: %w", err)
+	}
+	f, err := os.OpenFile(progressPath(j.path), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("writing sync journal progress: %w", err)
+	}
+	// Each line starts with a newline, so one cut off by an interruption
+	// doesn't run into the next
+	_, err = f.Write(append([]byte("\n"), b...))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("writing sync journal progress: %w", err)
+	}
+	return nil
+}
+
+// progressPath returns the path of the progress file of the journal at path.
+func progressPath(path string) string {
+	return path + ".progress"
+}
+
+// write saves the journal through a temporary file, so an interruption never
+// leaves it half written.
+func (j *Journal) write() error {
+	b, err := json.Marshal(j)
+	if err != nil {
+		return fmt.Errorf("encoding sync journal: %w", err)
+	}
+	if err := writeFileAtomic(j.path, b); err != nil {
+		return fmt.Errorf("writing sync journal: %w", err)
+	}
+	return nil
+}
+
+// writeFileAtomic writes b to path through a temporary file, creating the
+// directory if needed.
+func writeFileAtomic(path string, b []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Hash returns a hex SHA-256 hash identifying the entries of d, regardless
+// of their order.
+func (d *Data) Hash() string {
+	entries := make([]Entry, len(d.Entries))
+	copy(entries, d.Entries)
+	sort.Slice(entries, func(i, k int) bool { return entries[i].Key < entries[k].Key })
+	h := sha256.New()
+	for _, e := range entries {
+		fmt.Fprintf(h, "%d:%s%d:%s", len(e.Key), e.Key, len(e.Value), e.Value)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
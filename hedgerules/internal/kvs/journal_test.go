@@ -0,0 +1,214 @@
+package kvs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testPlan(n int) *SyncPlan {
+	plan := &SyncPlan{Deletes: []string{"/old1", "/old2"}}
+	for i := 0; i < n; i++ {
+		plan.Puts = append(plan.Puts, Entry{Key: fmt.Sprintf("/page%d", i), Value: "/dest/"})
+	}
+	return plan
+}
+
+func TestJournal_Checkpoints(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "sync.json")
+	data := &Data{Entries: []Entry{{Key: "/a", Value: "/b"}}}
+	plan := testPlan(120)
+
+	journal, err := NewJournal(path, "arn:test", data, plan, "etag-0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	written, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Sync(context.Background(), &mockKVSClient{}, "arn:test", "etag-0", plan, 0, journal); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+
+	// The plan is written once; checkpoints only append progress
+	if b, _ := os.ReadFile(path); !bytes.Equal(b, written) {
+		t.Error("expected checkpoints to leave the plan file alone")
+	}
+	if b, _ := os.ReadFile(progressPath(path)); bytes.Count(b, []byte(`"etag"`)) != 3 {
+		t.Errorf("expected a progress line per batch, got %q", b)
+	}
+
+	loaded, err := LoadJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Done != 122 || loaded.ETag != "etag-3" {
+		t.Errorf("expected 122 operations done at etag-3, got %d at %s", loaded.Done, loaded.ETag)
+	}
+	if !loaded.Matches("arn:test", data) || loaded.Matches("arn:other", data) {
+		t.Error("Matches gave the wrong answer")
+	}
+	if r := loaded.Remaining(); len(r.Puts) != 0 || len(r.Deletes) != 0 {
+		t.Errorf("expected nothing remaining, got %v", r)
+	}
+
+	if err := loaded.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if j, err := LoadJournal(path); j != nil || err != nil {
+		t.Errorf("expected no journal after Remove, got %v, %v", j, err)
+	}
+	if _, err := os.Stat(progressPath(path)); !os.IsNotExist(err) {
+		t.Errorf("expected no progress file after Remove, got %v", err)
+	}
+}
+
+func TestJournal_TornCheckpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sync.json")
+	if err := os.WriteFile(progressPath(path), []byte("stale\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	journal, err := NewJournal(path, "arn:test", &Data{}, testPlan(120), "etag-0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j, err := LoadJournal(path); err != nil || j.Done != 0 || j.ETag != "etag-0" {
+		t.Fatalf("expected a new journal to drop earlier progress, got %+v, %v", j, err)
+	}
+
+	if err := journal.checkpoint(50, "etag-1"); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(progressPath(path), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("\n" + `{"done":100,"et`)
+	f.Close()
+
+	loaded, err := LoadJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Done != 50 || loaded.ETag != "etag-1" {
+		t.Errorf("expected the last complete checkpoint, 50 at etag-1, got %d at %s", loaded.Done, loaded.ETag)
+	}
+
+	// Checkpoints after the resumed sync's first batch are still read
+	if err := loaded.checkpoint(100, "etag-2"); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, err = LoadJournal(path); err != nil || loaded.Done != 100 || loaded.ETag != "etag-2" {
+		t.Errorf("expected 100 at etag-2 after resuming, got %+v, %v", loaded, err)
+	}
+}
+
+func TestJournal_InterruptAndResume(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sync.json")
+	data := &Data{}
+	plan := testPlan(120)
+	journal, err := NewJournal(path, "arn:test", data, plan, "etag-0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Interrupted during the first batch, which still completes
+	ctx, cancel := context.WithCancel(context.Background())
+	mock := &mockKVSClient{onUpdate: cancel}
+	err = Sync(ctx, mock, "arn:test", "etag-0", plan, 0, journal)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if len(mock.updateKeysCalls) != 1 {
+		t.Fatalf("expected 1 UpdateKeys call, got %d", len(mock.updateKeysCalls))
+	}
+
+	loaded, err := LoadJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Done != 50 || loaded.ETag != "etag-1" {
+		t.Fatalf("expected 50 operations done at etag-1, got %d at %s", loaded.Done, loaded.ETag)
+	}
+
+	// Resume with the rest, continuing the count
+	remaining := loaded.Remaining()
+	if len(remaining.Puts) != 70 || len(remaining.Deletes) != 2 {
+		t.Fatalf("expected 70 puts and 2 deletes remaining, got %d and %d", len(remaining.Puts), len(remaining.Deletes))
+	}
+	mock = &mockKVSClient{nextETag: 1}
+	if err := Sync(context.Background(), mock, "arn:test", loaded.ETag, remaining, 0, loaded); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	if mock.updateKeysCalls[0].etag != "etag-1" {
+		t.Errorf("expected resumed sync to start at etag-1, got %s", mock.updateKeysCalls[0].etag)
+	}
+	if loaded.Done != 122 {
+		t.Errorf("expected 122 operations done, got %d", loaded.Done)
+	}
+}
+
+func TestJournal_RemainingDeletes(t *testing.T) {
+	j := &Journal{Plan: *testPlan(3), Done: 4}
+	r := j.Remaining()
+	if len(r.Puts) != 0 || len(r.Deletes) != 1 || r.Deletes[0] != "/old2" {
+		t.Errorf("unexpected remaining %v", r)
+	}
+}
+
+func TestDataHash(t *testing.T) {
+	a := &Data{Entries: []Entry{{Key: "/a", Value: "1"}, {Key: "/b", Value: "2"}}}
+	b := &Data{Entries: []Entry{{Key: "/b", Value: "2"}, {Key: "/a", Value: "1"}}}
+	c := &Data{Entries: []Entry{{Key: "/a", Value: "1"}, {Key: "/b", Value: "3"}}}
+	if a.Hash() != b.Hash() {
+		t.Error("expected order not to change the hash")
+	}
+	if a.Hash() == c.Hash() {
+		t.Error("expected a different value to change the hash")
+	}
+}
+
+func TestJournal_InterruptBeforeFinally(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sync.json")
+	plan := &SyncPlan{
+		Puts:    []Entry{{Key: ManifestPrefix + "0000", Value: "union"}},
+		Deletes: []string{"/old"},
+		Finally: &SyncPlan{Puts: []Entry{{Key: ManifestPrefix + "0000", Value: "exact"}}},
+	}
+	journal, err := NewJournal(path, "arn:test", &Data{}, plan, "etag-0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Finally goes in a batch of its own, so an interruption during the
+	// first batch leaves it for the resumed sync
+	ctx, cancel := context.WithCancel(context.Background())
+	mock := &mockKVSClient{onUpdate: cancel}
+	if err := Sync(ctx, mock, "arn:test", "etag-0", plan, 0, journal); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if len(mock.updateKeysCalls) != 1 || mock.updateKeysCalls[0].deleteCount != 1 {
+		t.Fatalf("expected one batch with the delete, got %v", mock.updateKeysCalls)
+	}
+
+	loaded, err := LoadJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := loaded.Remaining()
+	if len(r.Puts)+len(r.Deletes) != 0 || r.Finally == nil || len(r.Finally.Puts) != 1 || r.Finally.Puts[0].Value != "exact" {
+		t.Fatalf("expected only the exact manifest remaining, got %+v", r)
+	}
+	mock = &mockKVSClient{}
+	if err := Sync(context.Background(), mock, "arn:test", loaded.ETag, r, 0, loaded); err != nil {
+		t.Fatal(err)
+	}
+	if len(mock.updateKeysCalls) != 1 || mock.updateKeysCalls[0].putCount != 1 {
+		t.Errorf("expected the resumed sync to write the manifest, got %v", mock.updateKeysCalls)
+	}
+}
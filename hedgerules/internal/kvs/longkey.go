@@ -0,0 +1,54 @@
+package kvs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// LongKeyPrefix starts the key an entry is stored under when its own key is
+// longer than MaxKeyBytes. No redirect or header key starts with it.
+const LongKeyPrefix = "$"
+
+// LongKey returns the key to store key under: key itself, or, if it is
+// longer than MaxKeyBytes, LongKeyPrefix and the first 32 hex digits of its
+// SHA-256 hash. The CloudFront Functions hash the keys they look up the same
+// way.
+func LongKey(key string) string {
+	if len(key) <= MaxKeyBytes {
+		return key
+	}
+	sum := sha256.Sum256([]byte(key))
+	return LongKeyPrefix + hex.EncodeToString(sum[:])[:32]
+}
+
+// HashLongKeys returns copies of data sets stored in one KVS with their keys
+// replaced by LongKey, and an error for each hashed key that is the same as
+// another key in the store.
+func HashLongKeys(sets ...*Data) ([]*Data, []ValidationError) {
+	var errs []ValidationError
+	hashed := make([]*Data, len(sets))
+	owners := make(map[string]string)
+	for _, d := range sets {
+		for _, e := range d.Entries {
+			owners[e.Key] = e.Key
+		}
+	}
+	for i, d := range sets {
+		hashed[i] = &Data{Entries: make([]Entry, len(d.Entries)), CheckValue: d.CheckValue}
+		for j, e := range d.Entries {
+			key := LongKey(e.Key)
+			if key != e.Key {
+				if owner, ok := owners[key]; ok {
+					errs = append(errs, ValidationError{
+						Key:     e.Key,
+						Message: fmt.Sprintf("hashed key %s collides with %s", key, owner),
+					})
+				}
+				owners[key] = e.Key
+			}
+			hashed[i].Entries[j] = Entry{Key: key, Value: e.Value}
+		}
+	}
+	return hashed, errs
+}
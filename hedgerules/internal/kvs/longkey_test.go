@@ -0,0 +1,47 @@
+package kvs
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLongKey(t *testing.T) {
+	short := "/" + strings.Repeat("a", MaxKeyBytes-1)
+	if got := LongKey(short); got != short {
+		t.Errorf("expected key of exactly %d bytes to be kept, got %q", MaxKeyBytes, got)
+	}
+
+	// Checked against viewer-request.js and viewer-response.js
+	long := "/" + strings.Repeat("é", 300)
+	want := "$231dd242ecfc1ffcf91c945d31187a76"
+	if got := LongKey(long); got != want {
+		t.Errorf("LongKey = %q, want %q", got, want)
+	}
+}
+
+func TestHashLongKeys(t *testing.T) {
+	long := "/" + strings.Repeat("a", MaxKeyBytes)
+	redirects := &Data{Entries: []Entry{{Key: "/a", Value: "/b"}, {Key: long, Value: "/c"}}}
+	headers := &Data{Entries: []Entry{{Key: "/", Value: "x"}}}
+
+	hashed, errs := HashLongKeys(redirects, headers)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors %v", errs)
+	}
+	if len(hashed) != 2 || hashed[0].Entries[0].Key != "/a" || hashed[0].Entries[1].Key != LongKey(long) {
+		t.Errorf("unexpected entries %v", hashed[0].Entries)
+	}
+	if redirects.Entries[1].Key != long {
+		t.Error("HashLongKeys modified the original data")
+	}
+	if errs := ValidateStore(hashed...); len(errs) > 0 {
+		t.Errorf("expected hashed data to validate, got %v", errs)
+	}
+
+	// A collision with a key in another set of the same store
+	headers = &Data{Entries: []Entry{{Key: LongKey(long), Value: "x"}}}
+	_, errs = HashLongKeys(redirects, headers)
+	if len(errs) != 1 || errs[0].Key != long {
+		t.Errorf("expected one collision error, got %v", errs)
+	}
+}
@@ -0,0 +1,27 @@
+package kvs
+
+// Key prefixes for the redirects and headers data sets when both share one
+// KVS. The CloudFront Functions prepend the same prefix to every lookup.
+const (
+	RedirectsPrefix = "r:"
+	HeadersPrefix   = "h:"
+)
+
+// WithPrefix returns a copy of d with prefix prepended to every key.
+func (d *Data) WithPrefix(prefix string) *Data {
+	entries := make([]Entry, len(d.Entries))
+	for i, e := range d.Entries {
+		entries[i] = Entry{Key: prefix + e.Key, Value: e.Value}
+	}
+	return &Data{Entries: entries, CheckValue: d.CheckValue}
+}
+
+// Combine returns the entries of several data sets as one, for syncing them
+// to a single KVS. Keys must already be distinct, e.g. through WithPrefix.
+func Combine(sets ...*Data) *Data {
+	combined := &Data{}
+	for _, d := range sets {
+		combined.Entries = append(combined.Entries, d.Entries...)
+	}
+	return combined
+}
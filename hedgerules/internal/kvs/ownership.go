@@ -0,0 +1,163 @@
+package kvs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ManifestPrefix starts the keys of the ownership manifest, which records
+// the keys hedgerules manages in a KVS. No redirect or header key starts
+// with it.
+const ManifestPrefix = "~manifest/"
+
+// fingerprintLen is the number of hex digits of a key's SHA-256 hash the
+// manifest records for it.
+const fingerprintLen = 12
+
+// Manifest returns ownership manifest entries recording every key of the
+// data sets stored in one KVS as managed. Keys are recorded as fingerprints,
+// packed into as few entries as fit.
+func Manifest(sets ...*Data) *Data {
+	prints := make(map[string]bool)
+	for _, d := range sets {
+		for _, e := range d.Entries {
+			prints[fingerprint(e.Key)] = true
+		}
+	}
+	return manifestOf(prints)
+}
+
+// manifestOf returns the manifest entries recording a set of fingerprints.
+func manifestOf(prints map[string]bool) *Data {
+	sorted := make([]string, 0, len(prints))
+	for p := range prints {
+		sorted = append(sorted, p)
+	}
+	sort.Strings(sorted)
+
+	manifest := &Data{}
+	key := func(i int) string { return fmt.Sprintf("%s%04d", ManifestPrefix, i) }
+	perEntry := (MaxEntryBytes - len(key(0))) / fingerprintLen
+	for i := 0; i < len(sorted); i += perEntry {
+		end := min(i+perEntry, len(sorted))
+		manifest.Entries = append(manifest.Entries, Entry{
+			Key:   key(len(manifest.Entries)),
+			Value: strings.Join(sorted[i:end], ""),
+		})
+	}
+	return manifest
+}
+
+// managedPrints returns the fingerprints the ownership manifest in existing
+// records.
+func managedPrints(existing map[string]string) map[string]bool {
+	managed := make(map[string]bool)
+	for k, v := range existing {
+		if !strings.HasPrefix(k, ManifestPrefix) {
+			continue
+		}
+		for i := 0; i+fingerprintLen <= len(v); i += fingerprintLen {
+			managed[v[i:i+fingerprintLen]] = true
+		}
+	}
+	return managed
+}
+
+// KeepUnmanaged moves the deletes of keys that the ownership manifest in
+// existing does not record into Unmanaged, so the sync leaves them alone.
+// The manifest's own keys are always managed. Without a manifest, as before
+// the first sync that writes one, no other key is.
+func (p *SyncPlan) KeepUnmanaged(existing map[string]string) {
+	managed := managedPrints(existing)
+	var deletes []string
+	for _, k := range p.Deletes {
+		if strings.HasPrefix(k, ManifestPrefix) || managed[fingerprint(k)] {
+			deletes = append(deletes, k)
+		} else {
+			p.Unmanaged = append(p.Unmanaged, k)
+		}
+	}
+	p.Deletes = deletes
+	sort.Strings(p.Unmanaged)
+}
+
+// StageManifest reorders a plan that syncs data, including its ownership
+// manifest, to a KVS holding existing, so that the manifest in the KVS
+// records every key the sync may still delete, whenever it stops. The plan
+// first writes a manifest recording both the keys the existing manifest
+// records and the keys of data, then puts the other keys and deletes what
+// it deletes; Finally writes the manifest of data alone.
+//
+// The union manifest can be larger than either, and the KVS holds it along
+// with every key put and every key not yet deleted, so StageManifest returns
+// an error if the KVS would go over its limits at that point.
+func (p *SyncPlan) StageManifest(data *Data, existing map[string]string) error {
+	prints := managedPrints(existing)
+	var puts []Entry
+	for _, e := range data.Entries {
+		if !strings.HasPrefix(e.Key, ManifestPrefix) {
+			prints[fingerprint(e.Key)] = true
+		}
+	}
+	for _, e := range p.Puts {
+		if !strings.HasPrefix(e.Key, ManifestPrefix) {
+			puts = append(puts, e)
+		}
+	}
+	var deletes []string
+	for _, k := range p.Deletes {
+		if !strings.HasPrefix(k, ManifestPrefix) {
+			deletes = append(deletes, k)
+		}
+	}
+
+	// The union manifest goes first, so keys put after it are recorded
+	union := manifestOf(prints)
+	staged := ComputeSyncPlan(union, existing)
+	p.Puts = append(staged.Puts, puts...)
+	p.Deletes = deletes
+
+	peak := ApplyPlan(existing, &SyncPlan{Puts: p.Puts})
+	keys := make([]string, 0, len(peak))
+	for k := range peak {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	held := &Data{}
+	for _, k := range keys {
+		held.Entries = append(held.Entries, Entry{Key: k, Value: peak[k]})
+	}
+	if errs := ValidateStore(held); len(errs) > 0 {
+		msgs := make([]string, len(errs))
+		for i, e := range errs {
+			msgs[i] = e.Error()
+		}
+		return fmt.Errorf("the KVS would go over its limits before the sync deletes anything, while it holds the ownership manifest of both the old and the new keys: %s", strings.Join(msgs, "; "))
+	}
+
+	exact := &Data{}
+	for _, e := range data.Entries {
+		if strings.HasPrefix(e.Key, ManifestPrefix) {
+			exact.Entries = append(exact.Entries, e)
+		}
+	}
+	manifests := make(map[string]string)
+	for k, v := range ApplyPlan(existing, &SyncPlan{Puts: staged.Puts}) {
+		if strings.HasPrefix(k, ManifestPrefix) {
+			manifests[k] = v
+		}
+	}
+	p.Finally = ComputeSyncPlan(exact, manifests)
+	if len(p.Finally.Puts)+len(p.Finally.Deletes) == 0 {
+		p.Finally = nil
+	}
+	return nil
+}
+
+func fingerprint(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])[:fingerprintLen]
+}
@@ -0,0 +1,141 @@
+package kvs
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	d := &Data{}
+	for i := 0; i < 200; i++ {
+		d.Entries = append(d.Entries, Entry{Key: fmt.Sprintf("/page%d", i), Value: "/dest/"})
+	}
+	manifest := Manifest(d)
+	if len(manifest.Entries) != 3 {
+		t.Fatalf("expected 200 keys in 3 entries, got %d", len(manifest.Entries))
+	}
+	if manifest.Entries[0].Key != "~manifest/0000" || manifest.Entries[2].Key != "~manifest/0002" {
+		t.Errorf("unexpected manifest keys %s, %s", manifest.Entries[0].Key, manifest.Entries[2].Key)
+	}
+	if errs := manifest.Validate(); len(errs) > 0 {
+		t.Errorf("expected manifest to validate, got %v", errs)
+	}
+	if len(Manifest(&Data{}).Entries) != 0 {
+		t.Error("expected no manifest entries for no keys")
+	}
+}
+
+func TestKeepUnmanaged(t *testing.T) {
+	previous := &Data{Entries: []Entry{{Key: "/old", Value: "/x/"}, {Key: "/kept", Value: "/y/"}}}
+	existing := map[string]string{
+		"/old":           "/x/",
+		"/kept":          "/y/",
+		"/emergency":     "/z/",
+		"~manifest/0001": "stale",
+	}
+	for _, e := range Manifest(previous).Entries {
+		existing[e.Key] = e.Value
+	}
+
+	desired := &Data{Entries: []Entry{{Key: "/kept", Value: "/y/"}}}
+	desired = Combine(desired, Manifest(desired))
+	plan := ComputeSyncPlan(desired, existing)
+	plan.KeepUnmanaged(existing)
+
+	if len(plan.Unmanaged) != 1 || plan.Unmanaged[0] != "/emergency" {
+		t.Errorf("expected /emergency left alone, got %v", plan.Unmanaged)
+	}
+	deletes := strings.Join(plan.Deletes, ",")
+	if !strings.Contains(deletes, "/old") || !strings.Contains(deletes, "~manifest/0001") || len(plan.Deletes) != 2 {
+		t.Errorf("expected /old and the stale manifest entry deleted, got %v", plan.Deletes)
+	}
+}
+
+func TestKeepUnmanaged_NoManifest(t *testing.T) {
+	plan := &SyncPlan{Deletes: []string{"/b", "/a"}}
+	plan.KeepUnmanaged(map[string]string{"/a": "1", "/b": "2"})
+	if len(plan.Deletes) != 0 || strings.Join(plan.Unmanaged, ",") != "/a,/b" {
+		t.Errorf("expected every key left alone without a manifest, got %v", plan)
+	}
+}
+
+func TestStageManifest(t *testing.T) {
+	previous := &Data{Entries: []Entry{{Key: "/old", Value: "/x/"}, {Key: "/kept", Value: "/y/"}}}
+	existing := map[string]string{"/old": "/x/", "/kept": "/y/", "/emergency": "/z/"}
+	for _, e := range Manifest(previous).Entries {
+		existing[e.Key] = e.Value
+	}
+	desired := &Data{Entries: []Entry{{Key: "/kept", Value: "/y/"}, {Key: "/new", Value: "/w/"}}}
+	manifest := Manifest(desired)
+	desired = Combine(desired, manifest)
+
+	replan := func(state map[string]string) *SyncPlan {
+		plan := ComputeSyncPlan(desired, state)
+		plan.KeepUnmanaged(state)
+		if err := plan.StageManifest(desired, state); err != nil {
+			t.Fatal(err)
+		}
+		return plan
+	}
+	plan := replan(existing)
+	if len(plan.Puts) != 2 || !strings.HasPrefix(plan.Puts[0].Key, ManifestPrefix) || plan.Puts[1].Key != "/new" {
+		t.Fatalf("expected the manifest put before /new, got %v", plan.Puts)
+	}
+	if len(plan.Deletes) != 1 || plan.Deletes[0] != "/old" || plan.Finally == nil {
+		t.Fatalf("expected /old deleted before the exact manifest, got %+v", plan)
+	}
+
+	// Interrupted after the first manifest is written: /old is still
+	// recorded, so the next sync deletes it
+	state := ApplyPlan(existing, &SyncPlan{Puts: plan.Puts[:1]})
+	if again := replan(state); len(again.Deletes) != 1 || again.Deletes[0] != "/old" || len(again.Unmanaged) != 1 {
+		t.Errorf("expected /old still deleted and only /emergency left alone, got %+v", again)
+	}
+
+	// Interrupted before Finally: only the manifest is left to write
+	state = ApplyPlan(existing, &SyncPlan{Puts: plan.Puts, Deletes: plan.Deletes})
+	if again := replan(state); len(again.Puts)+len(again.Deletes) != 0 || again.Finally == nil {
+		t.Errorf("expected only the exact manifest left, got %+v", again)
+	}
+
+	// Done: the KVS holds the exact manifest of desired
+	state = ApplyPlan(existing, plan)
+	for _, e := range manifest.Entries {
+		if state[e.Key] != e.Value {
+			t.Errorf("%s: expected the exact manifest, got %q", e.Key, state[e.Key])
+		}
+	}
+	if again := replan(state); len(again.Puts)+len(again.Deletes) != 0 || again.Finally != nil {
+		t.Errorf("expected nothing left to do, got %+v", again)
+	}
+}
+
+func TestStageManifest_UnionTooLarge(t *testing.T) {
+	// The KVS records more keys than it holds, as when a previous sync
+	// stopped partway, so the union manifest is much larger than the exact one
+	prints := make(map[string]bool)
+	for i := 0; i < 80000; i++ {
+		prints[fingerprint(fmt.Sprintf("/gone%d", i))] = true
+	}
+	existing := make(map[string]string)
+	for _, e := range manifestOf(prints).Entries {
+		existing[e.Key] = e.Value
+	}
+
+	desired := &Data{}
+	for i := 0; i < 4300; i++ {
+		desired.Entries = append(desired.Entries, Entry{Key: fmt.Sprintf("/page%04d", i), Value: strings.Repeat("x", 1000)})
+	}
+	desired = Combine(desired, Manifest(desired))
+	if errs := desired.Validate(); len(errs) > 0 {
+		t.Fatalf("expected the data and its exact manifest to fit, got %v", errs)
+	}
+
+	plan := ComputeSyncPlan(desired, existing)
+	plan.KeepUnmanaged(existing)
+	err := plan.StageManifest(desired, existing)
+	if err == nil || !strings.Contains(err.Error(), "total data exceeds") {
+		t.Errorf("expected the union manifest to go over the store budget, got %v", err)
+	}
+}
@@ -0,0 +1,123 @@
+package kvs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// snapshotTimeFormat names snapshot files so they sort by the time taken.
+const snapshotTimeFormat = "20060102T150405.000Z"
+
+// Snapshot is the contents of a KVS at one point in time, as returned by
+// FetchExistingKeys.
+type Snapshot struct {
+	KVSARN  string            `json:"kvsArn"`
+	ETag    string            `json:"etag"`
+	Time    time.Time         `json:"time"`
+	Entries map[string]string `json:"entries"`
+}
+
+// ReadSnapshot reads a snapshot written by Write.
+func ReadSnapshot(r io.Reader) (*Snapshot, error) {
+	s := &Snapshot{}
+	if err := json.NewDecoder(r).Decode(s); err != nil {
+		return nil, fmt.Errorf("reading snapshot: %w", err)
+	}
+	if s.Entries == nil {
+		return nil, fmt.Errorf("reading snapshot: no entries")
+	}
+	return s, nil
+}
+
+// Write writes the snapshot as indented JSON.
+func (s *Snapshot) Write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(s); err != nil {
+		return fmt.Errorf("writing snapshot: %w", err)
+	}
+	return nil
+}
+
+// Data returns the entries of the snapshot, sorted by key, for syncing them
+// back to a KVS.
+func (s *Snapshot) Data() *Data {
+	d := &Data{}
+	for k, v := range s.Entries {
+		d.Entries = append(d.Entries, Entry{Key: k, Value: v})
+	}
+	sort.Slice(d.Entries, func(i, k int) bool { return d.Entries[i].Key < d.Entries[k].Key })
+	return d
+}
+
+// SaveSnapshot writes s to a file in dir named after the time it was taken,
+// then removes all but the newest keep snapshots in dir. It returns the path
+// of the new file.
+func SaveSnapshot(dir string, s *Snapshot, keep int) (string, error) {
+	var b bytes.Buffer
+	if err := s.Write(&b); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, s.Time.UTC().Format(snapshotTimeFormat)+".json")
+	if err := writeFileAtomic(path, b.Bytes()); err != nil {
+		return "", fmt.Errorf("saving snapshot: %w", err)
+	}
+
+	paths, err := snapshotPaths(dir)
+	if err != nil {
+		return "", err
+	}
+	for len(paths) > keep {
+		if err := os.Remove(paths[0]); err != nil {
+			return "", fmt.Errorf("removing old snapshot: %w", err)
+		}
+		paths = paths[1:]
+	}
+	return path, nil
+}
+
+// LatestSnapshot returns the newest snapshot saved in dir and its path, or
+// nil if there is none.
+func LatestSnapshot(dir string) (*Snapshot, string, error) {
+	paths, err := snapshotPaths(dir)
+	if err != nil || len(paths) == 0 {
+		return nil, "", err
+	}
+	path := paths[len(paths)-1]
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("reading snapshot: %w", err)
+	}
+	defer f.Close()
+	s, err := ReadSnapshot(f)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %w", path, err)
+	}
+	return s, path, nil
+}
+
+// snapshotPaths returns the snapshot files in dir, oldest first.
+func snapshotPaths(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("listing snapshots: %w", err)
+	}
+	var paths []string
+	for _, e := range entries {
+		if !e.IsDir() && filepath.Ext(e.Name()) == ".json" {
+			paths = append(paths, filepath.Join(dir, e.Name()))
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
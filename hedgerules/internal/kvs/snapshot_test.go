@@ -0,0 +1,67 @@
+package kvs
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSnapshot_RoundTrip(t *testing.T) {
+	s := &Snapshot{
+		KVSARN:  "arn:test",
+		ETag:    "etag-1",
+		Time:    time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC),
+		Entries: map[string]string{"/b": "/c/", "/a": "/d/"},
+	}
+	var buf bytes.Buffer
+	if err := s.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadSnapshot(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.KVSARN != "arn:test" || read.ETag != "etag-1" || !read.Time.Equal(s.Time) {
+		t.Errorf("unexpected snapshot %+v", read)
+	}
+	data := read.Data()
+	if len(data.Entries) != 2 || data.Entries[0].Key != "/a" || data.Entries[1].Value != "/c/" {
+		t.Errorf("expected entries sorted by key, got %v", data.Entries)
+	}
+
+	if _, err := ReadSnapshot(strings.NewReader(`{"kvsArn": "arn:test"}`)); err == nil {
+		t.Error("expected an error for a snapshot without entries")
+	}
+}
+
+func TestSaveSnapshot_Retention(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "snapshots")
+	if s, _, err := LatestSnapshot(dir); err != nil || s != nil {
+		t.Fatalf("expected no snapshot, got %v, %v", s, err)
+	}
+
+	start := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		s := &Snapshot{KVSARN: "arn:test", ETag: string(rune('a' + i)), Time: start.Add(time.Duration(i) * time.Minute), Entries: map[string]string{}}
+		if _, err := SaveSnapshot(dir, s, 3); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	paths, err := snapshotPaths(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 3 || filepath.Base(paths[0]) != "20261018T120200.000Z.json" {
+		t.Errorf("expected the newest 3 snapshots kept, got %v", paths)
+	}
+	latest, path, err := LatestSnapshot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest.ETag != "e" || filepath.Base(path) != "20261018T120400.000Z.json" {
+		t.Errorf("expected the newest snapshot, got %s from %s", latest.ETag, path)
+	}
+}
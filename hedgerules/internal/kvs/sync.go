@@ -2,10 +2,13 @@ package kvs
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sort"
 
 	"github.com/aws/aws-sdk-go-v2/service/cloudfrontkeyvaluestore"
 	cfkvstypes "github.com/aws/aws-sdk-go-v2/service/cloudfrontkeyvaluestore/types"
+	"github.com/aws/smithy-go"
 	"github.com/mrled/hedgerules/hedgerules/internal/retry"
 )
 
@@ -47,18 +50,10 @@ func ComputeSyncPlan(desired *Data, existingKeys map[string]string) *SyncPlan {
 // FetchExistingKeys retrieves all current keys and values from a KVS.
 func FetchExistingKeys(ctx context.Context, client KVSClient, kvsARN string, maxRetries int) (map[string]string, string, error) {
 	// Get ETag
-	var desc *cloudfrontkeyvaluestore.DescribeKeyValueStoreOutput
-	err := retry.Do(maxRetries, func() error {
-		var e error
-		desc, e = client.DescribeKeyValueStore(ctx, &cloudfrontkeyvaluestore.DescribeKeyValueStoreInput{
-			KvsARN: &kvsARN,
-		})
-		return e
-	})
+	etag, err := CurrentETag(ctx, client, kvsARN, maxRetries)
 	if err != nil {
-		return nil, "", fmt.Errorf("describing KVS: %w", err)
+		return nil, "", err
 	}
-	etag := *desc.ETag
 
 	existing := make(map[string]string)
 	var nextToken *string
@@ -89,16 +84,129 @@ func FetchExistingKeys(ctx context.Context, client KVSClient, kvsARN string, max
 	return existing, etag, nil
 }
 
+// CurrentETag returns the ETag of a KVS, which changes with every write.
+func CurrentETag(ctx context.Context, client KVSClient, kvsARN string, maxRetries int) (string, error) {
+	desc, err := describe(ctx, client, kvsARN, maxRetries)
+	if err != nil {
+		return "", err
+	}
+	return *desc.ETag, nil
+}
+
+// CountKeys returns the number of keys in a KVS.
+func CountKeys(ctx context.Context, client KVSClient, kvsARN string, maxRetries int) (int, error) {
+	desc, err := describe(ctx, client, kvsARN, maxRetries)
+	if err != nil {
+		return 0, err
+	}
+	if desc.ItemCount == nil {
+		return 0, nil
+	}
+	return int(*desc.ItemCount), nil
+}
+
+func describe(ctx context.Context, client KVSClient, kvsARN string, maxRetries int) (*cloudfrontkeyvaluestore.DescribeKeyValueStoreOutput, error) {
+	var desc *cloudfrontkeyvaluestore.DescribeKeyValueStoreOutput
+	err := retry.Do(maxRetries, func() error {
+		var e error
+		desc, e = client.DescribeKeyValueStore(ctx, &cloudfrontkeyvaluestore.DescribeKeyValueStoreInput{
+			KvsARN: &kvsARN,
+		})
+		return e
+	})
+	if err != nil {
+		return nil, fmt.Errorf("describing KVS: %w", err)
+	}
+	return desc, nil
+}
+
 // maxKeysPerBatch is the AWS CloudFront KVS limit for UpdateKeys API.
 // See: https://docs.aws.amazon.com/AmazonCloudFront/latest/DeveloperGuide/cloudfront-limits.html
 const maxKeysPerBatch = 50
 
+// ConflictError is returned by Sync when UpdateKeys fails its ETag
+// precondition because the KVS changed since its ETag was fetched. Applied
+// holds the operations of the batches that went through before it.
+type ConflictError struct {
+	Applied *SyncPlan
+	Err     error
+}
+
+func (e *ConflictError) Error() string {
+	puts, deletes := e.Applied.Size()
+	return fmt.Sprintf("KVS changed during sync after %d puts and %d deletes: %v", puts, deletes, e.Err)
+}
+
+func (e *ConflictError) Unwrap() error { return e.Err }
+
+// IsPreconditionFailed reports whether err is an UpdateKeys failure because
+// its IfMatch ETag is no longer current.
+func IsPreconditionFailed(err error) bool {
+	var conflict *cfkvstypes.ConflictException
+	if errors.As(err, &conflict) {
+		return true
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.ErrorCode() == "PreconditionFailed"
+	}
+	return false
+}
+
+// ApplyPlan returns existing with plan applied, as the KVS would hold it.
+func ApplyPlan(existing map[string]string, plan *SyncPlan) map[string]string {
+	result := make(map[string]string, len(existing)+len(plan.Puts))
+	for k, v := range existing {
+		result[k] = v
+	}
+	for _, e := range plan.Puts {
+		result[e.Key] = e.Value
+	}
+	for _, k := range plan.Deletes {
+		delete(result, k)
+	}
+	if plan.Finally != nil {
+		result = ApplyPlan(result, plan.Finally)
+	}
+	return result
+}
+
+// ChangedKeys returns the keys, sorted, that were added, removed or given a
+// different value between two states of a KVS.
+func ChangedKeys(before, after map[string]string) []string {
+	var changed []string
+	for k, v := range before {
+		if w, ok := after[k]; !ok || w != v {
+			changed = append(changed, k)
+		}
+	}
+	for k := range after {
+		if _, ok := before[k]; !ok {
+			changed = append(changed, k)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
 // Sync applies a SyncPlan to a CloudFront KVS using the batch UpdateKeys API.
 // Large operations are automatically split into multiple batches to respect AWS limits.
-func Sync(ctx context.Context, client KVSClient, kvsARN string, etag string, plan *SyncPlan, maxRetries int) error {
-	if len(plan.Puts) == 0 && len(plan.Deletes) == 0 {
+// If the KVS changes underneath it, Sync stops and returns a *ConflictError.
+// The operations in plan.Finally go in batches of their own, after all the
+// others.
+//
+// If journal is not nil, Sync checkpoints it after each batch; plan must be
+// what remains of the journal's plan. When ctx is canceled, Sync finishes
+// the batch in flight, so the journal stays accurate, and returns ctx's error.
+func Sync(ctx context.Context, client KVSClient, kvsARN string, etag string, plan *SyncPlan, maxRetries int, journal *Journal) error {
+	if puts, deletes := plan.Size(); puts+deletes == 0 {
 		return nil
 	}
+	var journaled int
+	if journal != nil {
+		journaled = journal.Done
+	}
+	batchCtx := context.WithoutCancel(ctx)
 
 	// Convert entries to API types
 	var puts []cfkvstypes.PutKeyRequestListItem
@@ -125,6 +233,12 @@ func Sync(ctx context.Context, client KVSClient, kvsARN string, etag string, pla
 	deletesIdx := 0
 
 	for putsIdx < len(puts) || deletesIdx < len(deletes) {
+		appliedPuts, appliedDeletes := putsIdx, deletesIdx
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("sync stopped after %d of %d operations: %w",
+				putsIdx+deletesIdx, len(puts)+len(deletes), err)
+		}
+
 		// Determine batch size for this iteration
 		remainingPuts := len(puts) - putsIdx
 		remainingDeletes := len(deletes) - deletesIdx
@@ -150,7 +264,7 @@ func Sync(ctx context.Context, client KVSClient, kvsARN string, etag string, pla
 		var resp *cloudfrontkeyvaluestore.UpdateKeysOutput
 		err := retry.Do(maxRetries, func() error {
 			var e error
-			resp, e = client.UpdateKeys(ctx, &cloudfrontkeyvaluestore.UpdateKeysInput{
+			resp, e = client.UpdateKeys(batchCtx, &cloudfrontkeyvaluestore.UpdateKeysInput{
 				KvsARN:  &kvsARN,
 				IfMatch: &currentETag,
 				Puts:    batchPuts,
@@ -158,6 +272,12 @@ func Sync(ctx context.Context, client KVSClient, kvsARN string, etag string, pla
 			})
 			return e
 		})
+		if IsPreconditionFailed(err) {
+			return &ConflictError{
+				Applied: &SyncPlan{Puts: plan.Puts[:appliedPuts], Deletes: plan.Deletes[:appliedDeletes]},
+				Err:     err,
+			}
+		}
 		if err != nil {
 			return fmt.Errorf("updating KVS keys (batch %d/%d puts, %d deletes): %w",
 				putsIdx, len(puts), deletesIdx, err)
@@ -167,7 +287,20 @@ func Sync(ctx context.Context, client KVSClient, kvsARN string, etag string, pla
 		if resp.ETag != nil {
 			currentETag = *resp.ETag
 		}
+		if journal != nil {
+			if err := journal.checkpoint(journaled+putsIdx+deletesIdx, currentETag); err != nil {
+				return err
+			}
+		}
 	}
 
+	if plan.Finally != nil {
+		err := Sync(ctx, client, kvsARN, currentETag, plan.Finally, maxRetries, journal)
+		var conflict *ConflictError
+		if errors.As(err, &conflict) {
+			conflict.Applied = &SyncPlan{Puts: plan.Puts, Deletes: plan.Deletes, Finally: conflict.Applied}
+		}
+		return err
+	}
 	return nil
 }
@@ -2,11 +2,13 @@ package kvs
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sort"
 	"testing"
 
 	"github.com/aws/aws-sdk-go-v2/service/cloudfrontkeyvaluestore"
+	cfkvstypes "github.com/aws/aws-sdk-go-v2/service/cloudfrontkeyvaluestore/types"
 )
 
 func TestComputeSyncPlan_NewKeys(t *testing.T) {
@@ -128,6 +130,13 @@ func TestComputeSyncPlan_Mixed(t *testing.T) {
 type mockKVSClient struct {
 	updateKeysCalls []mockUpdateKeysCall
 	nextETag        int
+
+	// conflictOnCall, if set, makes that UpdateKeys call (counting from 1)
+	// fail its ETag precondition
+	conflictOnCall int
+
+	// onUpdate, if set, is called during each UpdateKeys call
+	onUpdate func()
 }
 
 type mockUpdateKeysCall struct {
@@ -151,6 +160,12 @@ func (m *mockKVSClient) UpdateKeys(ctx context.Context, params *cloudfrontkeyval
 		etag:        *params.IfMatch,
 	}
 	m.updateKeysCalls = append(m.updateKeysCalls, call)
+	if m.onUpdate != nil {
+		m.onUpdate()
+	}
+	if len(m.updateKeysCalls) == m.conflictOnCall {
+		return nil, &cfkvstypes.ConflictException{Message: strPtr("ETag mismatch")}
+	}
 
 	// Return new ETag for next batch
 	m.nextETag++
@@ -170,7 +185,7 @@ func TestSync_SmallPlan(t *testing.T) {
 		Deletes: []string{"/old"},
 	}
 
-	err := Sync(context.Background(), mock, "arn:test", "etag-0", plan, 0)
+	err := Sync(context.Background(), mock, "arn:test", "etag-0", plan, 0, nil)
 	if err != nil {
 		t.Fatalf("Sync failed: %v", err)
 	}
@@ -202,7 +217,7 @@ func TestSync_ExactlyMaxBatch(t *testing.T) {
 
 	plan := &SyncPlan{Puts: puts}
 
-	err := Sync(context.Background(), mock, "arn:test", "etag-0", plan, 0)
+	err := Sync(context.Background(), mock, "arn:test", "etag-0", plan, 0, nil)
 	if err != nil {
 		t.Fatalf("Sync failed: %v", err)
 	}
@@ -228,7 +243,7 @@ func TestSync_MultipleBatches(t *testing.T) {
 
 	plan := &SyncPlan{Puts: puts}
 
-	err := Sync(context.Background(), mock, "arn:test", "etag-0", plan, 0)
+	err := Sync(context.Background(), mock, "arn:test", "etag-0", plan, 0, nil)
 	if err != nil {
 		t.Fatalf("Sync failed: %v", err)
 	}
@@ -281,7 +296,7 @@ func TestSync_MixedPutsAndDeletes(t *testing.T) {
 		Deletes: deletes,
 	}
 
-	err := Sync(context.Background(), mock, "arn:test", "etag-0", plan, 0)
+	err := Sync(context.Background(), mock, "arn:test", "etag-0", plan, 0, nil)
 	if err != nil {
 		t.Fatalf("Sync failed: %v", err)
 	}
@@ -313,7 +328,7 @@ func TestSync_EmptyPlan(t *testing.T) {
 	mock := &mockKVSClient{nextETag: 0}
 	plan := &SyncPlan{}
 
-	err := Sync(context.Background(), mock, "arn:test", "etag-0", plan, 0)
+	err := Sync(context.Background(), mock, "arn:test", "etag-0", plan, 0, nil)
 	if err != nil {
 		t.Fatalf("Sync failed: %v", err)
 	}
@@ -322,3 +337,50 @@ func TestSync_EmptyPlan(t *testing.T) {
 		t.Errorf("expected 0 UpdateKeys calls for empty plan, got %d", len(mock.updateKeysCalls))
 	}
 }
+
+func strPtr(s string) *string { return &s }
+
+func TestSync_Conflict(t *testing.T) {
+	mock := &mockKVSClient{conflictOnCall: 2}
+
+	puts := make([]Entry, 60)
+	for i := range puts {
+		puts[i] = Entry{Key: fmt.Sprintf("/page%d", i), Value: "/dest/"}
+	}
+	plan := &SyncPlan{Puts: puts, Deletes: []string{"/old"}}
+
+	err := Sync(context.Background(), mock, "arn:test", "etag-0", plan, 0, nil)
+	var conflict *ConflictError
+	if !errors.As(err, &conflict) {
+		t.Fatalf("expected ConflictError, got %v", err)
+	}
+	if len(conflict.Applied.Puts) != 50 || len(conflict.Applied.Deletes) != 0 {
+		t.Errorf("expected the first batch of 50 puts applied, got %d puts, %d deletes",
+			len(conflict.Applied.Puts), len(conflict.Applied.Deletes))
+	}
+	if !IsPreconditionFailed(err) {
+		t.Error("expected IsPreconditionFailed to see through ConflictError")
+	}
+}
+
+func TestApplyPlan(t *testing.T) {
+	existing := map[string]string{"/a": "1", "/b": "2"}
+	plan := &SyncPlan{Puts: []Entry{{Key: "/a", Value: "3"}, {Key: "/c", Value: "4"}}, Deletes: []string{"/b"}}
+	got := ApplyPlan(existing, plan)
+	if len(got) != 2 || got["/a"] != "3" || got["/c"] != "4" {
+		t.Errorf("unexpected result %v", got)
+	}
+	if existing["/a"] != "1" || existing["/b"] != "2" {
+		t.Error("ApplyPlan modified existing")
+	}
+}
+
+func TestChangedKeys(t *testing.T) {
+	before := map[string]string{"/same": "1", "/changed": "1", "/removed": "1"}
+	after := map[string]string{"/same": "1", "/changed": "2", "/added": "1"}
+	got := ChangedKeys(before, after)
+	want := []string{"/added", "/changed", "/removed"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("ChangedKeys = %v, want %v", got, want)
+	}
+}
@@ -9,10 +9,44 @@ type Entry struct {
 // Data holds all entries for a single KVS.
 type Data struct {
 	Entries []Entry
+
+	// CheckValue, if set, is called by Validate on every entry's value to
+	// apply constraints specific to what the KVS holds.
+	CheckValue func(value string) error
 }
 
 // SyncPlan describes what operations are needed to bring KVS to desired state.
 type SyncPlan struct {
 	Puts    []Entry  // Keys to add or update
 	Deletes []string // Keys to remove
+
+	// Keys not in the desired state that are left alone because hedgerules
+	// doesn't manage them (see KeepUnmanaged)
+	Unmanaged []string `json:",omitempty"`
+
+	// Operations to apply once all the others are done (see StageManifest)
+	Finally *SyncPlan `json:",omitempty"`
+}
+
+// Size returns the number of puts and deletes in the plan, including those
+// in Finally.
+func (p *SyncPlan) Size() (puts, deletes int) {
+	puts, deletes = len(p.Puts), len(p.Deletes)
+	if p.Finally != nil {
+		fp, fd := p.Finally.Size()
+		puts, deletes = puts+fp, deletes+fd
+	}
+	return puts, deletes
+}
+
+// after returns the operations of the plan left after the first done, in
+// the order Sync applies them.
+func (p *SyncPlan) after(done int) *SyncPlan {
+	puts := min(done, len(p.Puts))
+	deletes := min(max(done-len(p.Puts), 0), len(p.Deletes))
+	rest := &SyncPlan{Puts: p.Puts[puts:], Deletes: p.Deletes[deletes:], Unmanaged: p.Unmanaged}
+	if p.Finally != nil {
+		rest.Finally = p.Finally.after(max(done-len(p.Puts)-len(p.Deletes), 0))
+	}
+	return rest
 }
@@ -35,28 +35,43 @@ func (d *Data) Stats() DataStats {
 
 // Validate checks all KVS constraints. Returns nil if valid.
 func (d *Data) Validate() []ValidationError {
+	return ValidateStore(d)
+}
+
+// ValidateStore checks the KVS constraints for data sets stored in one KVS:
+// each entry against the per-key limits and its own set's CheckValue, and
+// the sets' combined size against MaxTotalBytes. Returns nil if valid.
+func ValidateStore(sets ...*Data) []ValidationError {
 	var errs []ValidationError
 	totalSize := 0
 
-	for _, e := range d.Entries {
-		keySize := len([]byte(e.Key))
-		entrySize := keySize + len([]byte(e.Value))
+	for _, d := range sets {
+		for _, e := range d.Entries {
+			keySize := len([]byte(e.Key))
+			entrySize := keySize + len([]byte(e.Value))
 
-		if keySize > MaxKeyBytes {
-			errs = append(errs, ValidationError{
-				Key:     e.Key,
-				Message: fmt.Sprintf("key exceeds %d bytes (%d bytes)", MaxKeyBytes, keySize),
-			})
-		}
+			if keySize > MaxKeyBytes {
+				errs = append(errs, ValidationError{
+					Key:     e.Key,
+					Message: fmt.Sprintf("key exceeds %d bytes (%d bytes)", MaxKeyBytes, keySize),
+				})
+			}
 
-		if entrySize > MaxEntryBytes {
-			errs = append(errs, ValidationError{
-				Key:     e.Key,
-				Message: fmt.Sprintf("key+value exceeds %d bytes (%d bytes)", MaxEntryBytes, entrySize),
-			})
-		}
+			if entrySize > MaxEntryBytes {
+				errs = append(errs, ValidationError{
+					Key:     e.Key,
+					Message: fmt.Sprintf("key+value exceeds %d bytes (%d bytes)", MaxEntryBytes, entrySize),
+				})
+			}
+
+			if d.CheckValue != nil {
+				if err := d.CheckValue(e.Value); err != nil {
+					errs = append(errs, ValidationError{Key: e.Key, Message: err.Error()})
+				}
+			}
 
-		totalSize += entrySize
+			totalSize += entrySize
+		}
 	}
 
 	if totalSize > MaxTotalBytes {
@@ -1,6 +1,7 @@
 package kvs
 
 import (
+	"fmt"
 	"strings"
 	"testing"
 )
@@ -111,3 +112,72 @@ func TestValidate_ExactBoundaries(t *testing.T) {
 		t.Errorf("expected entry of exactly 1024 bytes to pass, got %v", errs)
 	}
 }
+
+func TestValidate_CheckValue(t *testing.T) {
+	d := &Data{
+		Entries: []Entry{
+			{Key: "/good", Value: "ok"},
+			{Key: "/bad", Value: "nope"},
+		},
+		CheckValue: func(value string) error {
+			if value != "ok" {
+				return fmt.Errorf("bad value %q", value)
+			}
+			return nil
+		},
+	}
+	errs := d.Validate()
+	if len(errs) != 1 || errs[0].Key != "/bad" || !strings.Contains(errs[0].Message, "bad value") {
+		t.Errorf("expected one error for /bad, got %v", errs)
+	}
+}
+
+func TestValidateStore_Combined(t *testing.T) {
+	// Each set fits on its own, but not together
+	val := strings.Repeat("x", 990)
+	var a, b []Entry
+	for i := 0; i < 3000; i++ {
+		a = append(a, Entry{Key: fmt.Sprintf("/a%06d", i), Value: val})
+		b = append(b, Entry{Key: fmt.Sprintf("/b%06d", i), Value: val})
+	}
+	redirects := (&Data{Entries: a}).WithPrefix(RedirectsPrefix)
+	headers := (&Data{Entries: b}).WithPrefix(HeadersPrefix)
+	if errs := redirects.Validate(); len(errs) > 0 {
+		t.Fatalf("expected redirects alone to pass, got %v", errs[0])
+	}
+	errs := ValidateStore(redirects, headers)
+	if len(errs) != 1 || errs[0].Key != "(total)" {
+		t.Errorf("expected one total size error, got %v", errs)
+	}
+}
+
+func TestValidateStore_CheckValuePerSet(t *testing.T) {
+	redirects := &Data{Entries: []Entry{{Key: "r:/a", Value: "nope"}}}
+	headers := &Data{
+		Entries: []Entry{{Key: "h:/a", Value: "nope"}},
+		CheckValue: func(value string) error {
+			return fmt.Errorf("bad value %q", value)
+		},
+	}
+	errs := ValidateStore(redirects, headers)
+	if len(errs) != 1 || errs[0].Key != "h:/a" {
+		t.Errorf("expected one error for h:/a, got %v", errs)
+	}
+}
+
+func TestWithPrefix(t *testing.T) {
+	d := &Data{Entries: []Entry{{Key: "/a", Value: "/b"}}}
+	got := d.WithPrefix(RedirectsPrefix)
+	if len(got.Entries) != 1 || got.Entries[0] != (Entry{Key: "r:/a", Value: "/b"}) {
+		t.Errorf("unexpected entries %v", got.Entries)
+	}
+	if d.Entries[0].Key != "/a" {
+		t.Error("WithPrefix modified the original data")
+	}
+
+	// A prefix can push a key over the limit
+	long := (&Data{Entries: []Entry{{Key: strings.Repeat("a", MaxKeyBytes), Value: "x"}}}).WithPrefix(HeadersPrefix)
+	if errs := long.Validate(); len(errs) == 0 {
+		t.Error("expected prefixed key over the limit to fail")
+	}
+}